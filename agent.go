@@ -0,0 +1,90 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Agent maintains the tunnels to the gateways and proxies the streams opened through them, the way the binary does.
+// Each agent keeps its own settings, tunnels and limits, so several agents can run in one process.
+type Agent struct {
+	cfg      *Config
+	settings *settings
+	config   []byte
+	reload   chan os.Signal
+	refresh  chan os.Signal
+	stop     *drainSignal
+	done     chan struct{}
+
+	tunnels      *tunnelRegistry
+	connected    *tunnelTracker
+	authFailures *authFailureTracker
+}
+
+// NewAgent reads the config sent to the gateways from cfg.ConfigPath and returns an agent ready to be started.
+func NewAgent(cfg *Config) (*Agent, error) {
+	config, err := readConfig(cfg.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %s", err)
+	}
+	return newAgent(cfg, config), nil
+}
+
+func newAgent(cfg *Config, config []byte) *Agent {
+	s := cfg.settings()
+	return &Agent{
+		cfg:          cfg,
+		settings:     s,
+		config:       config,
+		reload:       make(chan os.Signal, 1),
+		refresh:      make(chan os.Signal, 1),
+		stop:         newDrainSignal(),
+		done:         make(chan struct{}),
+		tunnels:      newTunnelRegistry(),
+		connected:    newTunnelTracker(s.allDownTimeout, s.exitOnAllDown),
+		authFailures: newAuthFailureTracker(s.authFailureThreshold, s.exitOnAuthFailure),
+	}
+}
+
+// Start starts connecting to the gateways in the background.
+func (a *Agent) Start() {
+	go func() {
+		defer close(a.done)
+		a.loop()
+	}()
+}
+
+// Reload rereads the config from cfg.ConfigPath and reconnects the tunnels if it has changed, like SIGHUP does.
+func (a *Agent) Reload() {
+	select {
+	case a.reload <- nil:
+	default: // a reload is already pending
+	}
+}
+
+// Refresh fetches the gateway endpoints from the resolver immediately rather than on the next periodic refresh, like SIGUSR2 does.
+func (a *Agent) Refresh() {
+	select {
+	case a.refresh <- nil:
+	default: // a refresh is already pending
+	}
+}
+
+// Stop drains the tunnels within DRAIN_TIMEOUT and waits for the agent to exit.
+func (a *Agent) Stop() {
+	a.stop.request()
+	<-a.done
+}
+
+// Run runs an agent with the given settings until the context is canceled.
+func Run(ctx context.Context, cfg *Config) error {
+	a, err := NewAgent(cfg)
+	if err != nil {
+		return err
+	}
+	a.Start()
+	<-ctx.Done()
+	a.Stop()
+	return nil
+}
@@ -0,0 +1,62 @@
+package connect
+
+import (
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgent(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer destination.Close()
+
+	sessions := make(chan *yamux.Session, 1)
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		readHeaderAndConfig(t, conn, token, []byte("config_data"))
+		writeResponse(t, conn, StatusOK, "")
+		session, err := yamux.Client(conn, nil)
+		require.NoError(t, err)
+		sessions <- session
+	})
+	defer stop()
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(addr))
+	}))
+	defer resolver.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("config_data"), 0o644))
+	setRequiredEnv(t)
+	t.Setenv("CONFIG_PATH", configPath)
+	t.Setenv("RESOLVER_URL", resolver.URL)
+	t.Setenv("TLS_SKIP_VERIFY", "true")
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+
+	agent, err := NewAgent(cfg)
+	require.NoError(t, err)
+	agent.Start()
+	session := <-sessions
+	defer session.Close()
+	assert.Equal(t, "ok", httpGet(t, session, destination.Listener.Addr().String()))
+
+	agent.Stop()
+	assert.Empty(t, agent.tunnels.status())
+
+	cfg.ConfigPath = filepath.Join(t.TempDir(), "missing.yaml")
+	_, err = NewAgent(cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package connect_test
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/coroot/coroot-connect"
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEmbeddedAgents runs two agents with different settings in one process the way an embedding binary does.
+func TestEmbeddedAgents(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer destination.Close()
+	dest := destination.Listener.Addr().String()
+
+	// the first agent can reach any destination
+	permissive, sessions := plaintextGateway(t, "permissive")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- connect.Run(ctx, permissive)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+	session := <-sessions
+	defer session.Close()
+	res, err := get(session, dest)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", res)
+
+	// the second one is limited to another destination, which doesn't affect the first one
+	restricted, sessions := plaintextGateway(t, "restricted")
+	restricted.AllowedDestinations = []string{"10.0.0.1:80"}
+	agent, err := connect.NewAgent(restricted)
+	require.NoError(t, err)
+	agent.Start()
+	defer agent.Stop()
+	restrictedSession := <-sessions
+	defer restrictedSession.Close()
+	_, err = get(restrictedSession, dest)
+	assert.Error(t, err)
+
+	res, err = get(session, dest)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", res)
+}
+
+// plaintextGateway starts a fake gateway expecting the config and returns the config of an agent connecting to it
+// along with the gateway side of the sessions.
+func plaintextGateway(t *testing.T, config string) (*connect.Config, <-chan *yamux.Session) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	sessions := make(chan *yamux.Session, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			h := connect.RequestHeader{}
+			if err := binary.Read(conn, binary.LittleEndian, &h); err != nil {
+				conn.Close()
+				continue
+			}
+			data := make([]byte, int(h.ConfigSize))
+			if _, err = io.ReadFull(conn, data); err != nil || string(h.Token[:]) != token || string(data) != config {
+				conn.Close()
+				continue
+			}
+			if err = binary.Write(conn, binary.LittleEndian, connect.ResponseHeader{Status: connect.StatusOK}); err != nil {
+				conn.Close()
+				continue
+			}
+			session, err := yamux.Client(conn, nil)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			sessions <- session
+		}
+	}()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+	cfg := connect.DefaultConfig()
+	cfg.Token = token
+	cfg.ConfigPath = configPath
+	cfg.StaticEndpoints = []string{listener.Addr().String()}
+	cfg.TLSDisabled = true
+	cfg.DrainTimeout = connect.Duration(time.Second)
+	return cfg, sessions
+}
+
+// get requests the destination through a stream opened by the gateway.
+func get(session *yamux.Session, dest string) (string, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			stream, err := session.Open()
+			if err != nil {
+				return nil, err
+			}
+			if err = binary.Write(stream, binary.LittleEndian, uint16(len(dest))); err != nil {
+				return nil, err
+			}
+			if _, err = stream.Write([]byte(dest)); err != nil {
+				return nil, err
+			}
+			return stream, nil
+		},
+		DisableKeepAlives: true,
+	}
+	res, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get("http://any/")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	return string(data), err
+}
@@ -0,0 +1,74 @@
+package connect
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks the failed connections to the destinations.
+// Once threshold connections to a destination have failed in a row within window,
+// the streams to it are failed right away for cooldown instead of dialing a destination that seems to be down.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	lock         sync.Mutex
+	destinations map[string]*breakerState
+}
+
+type breakerState struct {
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown, destinations: map[string]*breakerState{}}
+}
+
+// allow returns false if the streams to the destination must be failed without dialing it.
+func (b *circuitBreaker) allow(destination string) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.destinations[destination]
+	return s == nil || !time.Now().Before(s.openUntil)
+}
+
+// failed records a failed connection to the destination and returns true if that has opened the breaker.
+func (b *circuitBreaker) failed(destination string) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	s := b.destinations[destination]
+	if s == nil {
+		s = &breakerState{}
+		b.destinations[destination] = s
+	}
+	if s.failures == 0 || now.Sub(s.firstFailure) > b.window {
+		s.failures, s.firstFailure = 0, now
+	}
+	s.failures++
+	if s.failures < b.threshold {
+		return false
+	}
+	s.failures = 0
+	s.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// succeeded closes the breaker of the destination.
+func (b *circuitBreaker) succeeded(destination string) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	delete(b.destinations, destination)
+	b.lock.Unlock()
+}
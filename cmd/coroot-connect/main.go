@@ -0,0 +1,9 @@
+package main
+
+import (
+	connect "github.com/coroot/coroot-connect"
+)
+
+func main() {
+	connect.Main()
+}
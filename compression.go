@@ -0,0 +1,52 @@
+package connect
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// compressionVersionSuffix is appended to the version sent in the handshake to advertise the support of compression.
+	// It is valid semver build metadata, so gateways unaware of it parse the version as usual.
+	// A gateway that compresses the tunnel replies with the "compression: deflate" capability.
+	compressionVersionSuffix = "+deflate"
+)
+
+// handshakeVersion returns the version to send in the handshake and whether it advertises compression.
+// Compression isn't advertised if TUNNEL_COMPRESSION is disabled or if the suffix doesn't fit into the version field.
+func (s *settings) handshakeVersion() (string, bool) {
+	if s.tunnelCompression && len(version)+len(compressionVersionSuffix) <= len(RequestHeader{}.Version) {
+		return version + compressionVersionSuffix, true
+	}
+	return version, false
+}
+
+// compressedConn compresses the data written to the connection and decompresses the data read from it.
+// Every write is flushed, so the yamux frames are never held back waiting for more data.
+type compressedConn struct {
+	net.Conn
+	r     io.ReadCloser
+	wLock sync.Mutex
+	w     *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressedConn{Conn: conn, r: flate.NewReader(conn), w: w}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
@@ -0,0 +1,149 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the bytes read from the connection.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestTunnelCompression(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	s.tunnelCompression = true
+
+	sessions := make(chan *yamux.Session, 1)
+	counter := &countingConn{}
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		h := RequestHeader{}
+		require.NoError(t, binary.Read(conn, binary.LittleEndian, &h))
+		assert.Equal(t, version+compressionVersionSuffix, string(bytes.Trim(h.Version[:], "\x00")))
+		_, err = io.ReadFull(conn, make([]byte, h.ConfigSize))
+		require.NoError(t, err)
+		writeResponse(t, conn, 200, "compression: deflate")
+		counter.Conn = conn
+		session, err := yamux.Client(newCompressedConn(counter), yamux.DefaultConfig())
+		require.NoError(t, err)
+		sessions <- session
+	})
+	defer stop()
+
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer destination.Close()
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	gwConn, err := s.connect(addr, "", token, []byte("config_data"))
+	require.NoError(t, err)
+	defer gwConn.Close()
+	require.IsType(t, &compressedConn{}, gwConn)
+	go func() {
+		_ = newProxy(s).Serve(context.Background(), gwConn)
+	}()
+	session := <-sessions
+	defer session.Close()
+
+	var b strings.Builder
+	for i := 0; b.Len() < 4<<20; i++ {
+		fmt.Fprintf(&b, "http_requests_total{instance=\"10.0.0.%d:8080\"} %d\n", i%256, i)
+	}
+	payload := []byte(b.String())
+
+	stream, err := openStream(session, destination.Addr().String())
+	require.NoError(t, err)
+	defer stream.Close()
+	go func() {
+		_, _ = stream.Write(payload)
+	}()
+	received := make([]byte, len(payload))
+	_, err = io.ReadFull(stream, received)
+	require.NoError(t, err)
+	assert.Equal(t, payload, received)
+	assert.Less(t, atomic.LoadInt64(&counter.read), int64(len(payload)/2))
+}
+
+func TestTunnelCompressionLongVersion(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	logs := captureLogs(t)
+	defer func(ver string) {
+		version = ver
+	}(version)
+	version = "1.5.10-3-gabcdef"
+	s := testSettings()
+	s.tunnelCompression = true
+
+	v, ok := s.handshakeVersion()
+	assert.False(t, ok)
+	assert.Equal(t, version, v)
+
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		readHeaderAndConfig(t, conn, token, []byte("config_data"))
+		writeResponse(t, conn, 200, "")
+	})
+	defer stop()
+	gwConn, err := s.connect(addr, "", token, []byte("config_data"))
+	require.NoError(t, err)
+	defer gwConn.Close()
+	assert.NotContains(t, logs.String(), "doesn't support compression")
+}
+
+func TestCompressedStandby(t *testing.T) {
+	agentSide, gatewaySide := net.Pipe()
+	defer agentSide.Close()
+	defer gatewaySide.Close()
+
+	s := &standby{}
+	conn := newCompressedConn(agentSide)
+	watched := s.set(context.Background(), conn)
+	require.NotNil(t, watched)
+	taken := make(chan bool, 1)
+	go func() {
+		taken <- s.watch(conn, watched)
+	}()
+	// writes to a pipe return once read, so the watcher has read the data sent while on standby
+	_, err := newCompressedConn(gatewaySide).Write([]byte("hello"))
+	require.NoError(t, err)
+
+	c := s.take()
+	require.NotNil(t, c)
+	assert.True(t, <-taken)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
@@ -0,0 +1,779 @@
+package connect
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration marshaled to JSON in its human-readable form, e.g. "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DestTimeout is the dial timeout of the destinations whose host matches the pattern.
+type DestTimeout struct {
+	Pattern string   `json:"pattern"`
+	Timeout Duration `json:"timeout"`
+}
+
+// Config holds the effective settings of the agent.
+type Config struct {
+	Token           string   `json:"token"`
+	ResolverUrls    []string `json:"resolver_urls"`
+	ConfigPath      string   `json:"config_path"`
+	ListenAddress   string   `json:"listen_address"`
+	PprofAddress    string   `json:"pprof_address"`
+	RuntimeMetrics  bool     `json:"runtime_metrics"`
+	ValidateOnly    bool     `json:"validate_only"`
+	LocalProxyCheck string   `json:"local_proxy_check"`
+	LogLevel        int      `json:"log_level"`
+	DumpGoroutines  bool     `json:"dump_goroutines"`
+
+	HealthCheckURL      string   `json:"health_check_url"`
+	HealthCheckInterval Duration `json:"health_check_interval"`
+
+	LogFile           string `json:"log_file"`
+	LogFileMaxSize    int    `json:"log_file_max_size_mb"`
+	LogFileMaxBackups int    `json:"log_file_max_backups"`
+	LogFileMaxAge     int    `json:"log_file_max_age_days"`
+
+	DialTimeout              Duration `json:"dial_timeout"`
+	HandshakeTimeout         Duration `json:"handshake_timeout"`
+	ConfigWriteTimeout       Duration `json:"config_write_timeout"`
+	ConfigWriteAttempts      int      `json:"config_write_attempts"`
+	DestinationTimeout       Duration `json:"destination_timeout"`
+	StreamTimeout            Duration `json:"stream_timeout"`
+	UDPIdleTimeout           Duration `json:"udp_idle_timeout"`
+	TCPKeepAlive             Duration `json:"tcp_keepalive"`
+	TCPNoDelay               bool     `json:"tcp_nodelay"`
+	TunnelCompression        bool     `json:"tunnel_compression"`
+	DSCP                     int      `json:"dscp"`
+	DestDialNetwork          string   `json:"dest_dial_network"`
+	GatewayDialNetwork       string   `json:"gateway_dial_network"`
+	GatewayIPOverride        string   `json:"gateway_ip_override"`
+	EndpointsRefreshInterval Duration `json:"endpoints_refresh_interval"`
+
+	AgentLabels map[string]string `json:"agent_labels"`
+
+	TunnelBackoffFactor   float64  `json:"tunnel_backoff_factor"`
+	TunnelBackoffMin      Duration `json:"tunnel_backoff_min"`
+	TunnelBackoffMax      Duration `json:"tunnel_backoff_max"`
+	BackoffResetAfter     Duration `json:"backoff_reset_after"`
+	ResolverBackoffFactor float64  `json:"resolver_backoff_factor"`
+	ResolverBackoffMin    Duration `json:"resolver_backoff_min"`
+	ResolverBackoffMax    Duration `json:"resolver_backoff_max"`
+
+	YamuxKeepAliveInterval Duration `json:"yamux_keepalive_interval"`
+	YamuxKeepAliveDisabled bool     `json:"yamux_keepalive_disabled"`
+	YamuxWriteTimeout      Duration `json:"yamux_write_timeout"`
+	YamuxAcceptBacklog     int      `json:"yamux_accept_backlog"`
+	MaxConcurrentStreams   int      `json:"max_concurrent_streams"`
+	CopyBufferSize         int      `json:"copy_buffer_size"`
+	GatewayReadTimeout     Duration `json:"gateway_read_timeout"`
+	TunnelMaxIdle          Duration `json:"tunnel_max_idle"`
+	TunnelMaxLifetime      Duration `json:"tunnel_max_lifetime"`
+	MaxStreamsPerSession   int      `json:"max_streams_per_session"`
+	MakeBeforeBreak        bool     `json:"make_before_break"`
+	WarmStandby            bool     `json:"warm_standby"`
+	SessionsPerEndpoint    int      `json:"sessions_per_endpoint"`
+	MinTunnels             int      `json:"min_tunnels"`
+	MaxConcurrentConnects  int      `json:"max_concurrent_connects"`
+
+	AllowedDestinations  []string `json:"allowed_destinations"`
+	AllowedPorts         []int    `json:"allowed_ports"`
+	SendProxyProtocol    bool     `json:"send_proxy_protocol"`
+	MaxDestinationSize   int      `json:"max_destination_size"`
+	MaxDestinationLabels int      `json:"max_destination_labels"`
+	SourceAddress        string   `json:"source_address"`
+	DNSServers           []string `json:"dns_servers"`
+	DestSocksProxy       string   `json:"dest_socks_proxy"`
+	DestTLS              bool     `json:"dest_tls"`
+	DestTLSSkipVerify    bool     `json:"dest_tls_skip_verify"`
+	DestTLSNextProtos    []string `json:"dest_tls_next_protos"`
+
+	Targets map[string]string `json:"targets"`
+
+	DestTimeouts []DestTimeout `json:"dest_timeouts"`
+
+	BreakerThreshold int      `json:"breaker_threshold"`
+	BreakerWindow    Duration `json:"breaker_window"`
+	BreakerCooldown  Duration `json:"breaker_cooldown"`
+	DestMaxRPS       int      `json:"dest_max_rps"`
+
+	TLSDisabled     bool     `json:"tls_disabled"`
+	TLSSkipVerify   bool     `json:"tls_skip_verify"`
+	TLSServerName   string   `json:"tls_server_name"`
+	TLSSessionCache bool     `json:"tls_session_cache"`
+	CertExpiryWarn  Duration `json:"cert_expiry_warn"`
+
+	ResolverTokenHeader string            `json:"resolver_token_header"`
+	ResolverTokenPrefix string            `json:"resolver_token_prefix"`
+	ResolverUserAgent   string            `json:"resolver_user_agent"`
+	ResolverHeaders     map[string]string `json:"resolver_headers"`
+	MaxResolverResponse int               `json:"max_resolver_response"`
+	EndpointsSeparator  string            `json:"endpoints_separator"`
+	StaticEndpoints     []string          `json:"static_endpoints"`
+
+	AuthFailureThreshold int      `json:"auth_failure_threshold"`
+	ExitOnAuthFailure    bool     `json:"exit_on_auth_failure"`
+	AllDownTimeout       Duration `json:"all_down_timeout"`
+	ExitOnAllDown        bool     `json:"exit_on_all_down"`
+	DrainTimeout         Duration `json:"drain_timeout"`
+	SessionStatsInterval Duration `json:"session_stats_interval"`
+}
+
+// DefaultConfig returns the settings used unless overridden.
+// Token and ConfigPath have no defaults and must be set before an agent is created with the config.
+func DefaultConfig() *Config {
+	return &Config{
+		ResolverUrls:        []string{defaultResolverUrl},
+		RuntimeMetrics:      true,
+		HealthCheckInterval: Duration(30 * time.Second),
+		LogFileMaxSize:      100,
+		LogFileMaxBackups:   3,
+		LogFileMaxAge:       28,
+
+		DialTimeout:              Duration(10 * time.Second),
+		HandshakeTimeout:         Duration(10 * time.Second),
+		ConfigWriteTimeout:       Duration(30 * time.Second),
+		ConfigWriteAttempts:      3,
+		DestinationTimeout:       Duration(10 * time.Second),
+		StreamTimeout:            Duration(5 * time.Minute),
+		UDPIdleTimeout:           Duration(time.Minute),
+		TCPKeepAlive:             Duration(15 * time.Second),
+		TCPNoDelay:               true,
+		DSCP:                     -1,
+		DestDialNetwork:          "tcp",
+		GatewayDialNetwork:       "tcp",
+		EndpointsRefreshInterval: Duration(10 * time.Minute),
+
+		TunnelBackoffFactor:   2,
+		TunnelBackoffMin:      Duration(5 * time.Second),
+		TunnelBackoffMax:      Duration(time.Minute),
+		BackoffResetAfter:     Duration(30 * time.Second),
+		ResolverBackoffFactor: 2,
+		ResolverBackoffMin:    Duration(5 * time.Second),
+		ResolverBackoffMax:    Duration(time.Minute),
+
+		YamuxKeepAliveInterval: Duration(time.Second),
+		YamuxWriteTimeout:      Duration(10 * time.Second),
+		YamuxAcceptBacklog:     256,
+		CopyBufferSize:         32 * 1024,
+		GatewayReadTimeout:     Duration(30 * time.Second),
+		SessionsPerEndpoint:    1,
+
+		// fits "udp://", the longest possible DNS name, and a port
+		MaxDestinationSize:   len("udp://") + 253 + len(":65535"),
+		MaxDestinationLabels: 100,
+
+		BreakerThreshold: 5,
+		BreakerWindow:    Duration(10 * time.Second),
+		BreakerCooldown:  Duration(30 * time.Second),
+
+		CertExpiryWarn: Duration(14 * 24 * time.Hour),
+
+		ResolverTokenHeader: "X-Token",
+		// limits the size of a resolver response after decompression
+		MaxResolverResponse: 1 << 20,
+		EndpointsSeparator:  ";",
+
+		AuthFailureThreshold: 10,
+		DrainTimeout:         Duration(5 * time.Minute),
+		SessionStatsInterval: Duration(15 * time.Second),
+	}
+}
+
+// LoadConfig parses and validates the settings from the environment variables.
+// The settings not set in the environment default to those of DefaultConfig.
+func LoadConfig() (*Config, error) {
+	env := &envReader{}
+	d := DefaultConfig()
+	cfg := &Config{
+		Token:           env.required("PROJECT_TOKEN"),
+		ResolverUrls:    resolverUrlsFromEnv(),
+		ConfigPath:      env.required("CONFIG_PATH"),
+		ListenAddress:   os.Getenv("LISTEN_ADDRESS"),
+		PprofAddress:    os.Getenv("PPROF_ADDRESS"),
+		RuntimeMetrics:  os.Getenv("RUNTIME_METRICS_DISABLED") != "true",
+		ValidateOnly:    os.Getenv("VALIDATE_ONLY") == "true",
+		LocalProxyCheck: os.Getenv("LOCAL_PROXY_CHECK"),
+		LogLevel:        env.int("LOG_LEVEL", 0),
+		DumpGoroutines:  os.Getenv("DUMP_GOROUTINES") == "true",
+
+		HealthCheckURL:      os.Getenv("HEALTH_CHECK_URL"),
+		HealthCheckInterval: env.duration("HEALTH_CHECK_INTERVAL", d.HealthCheckInterval),
+
+		LogFile:           os.Getenv("LOG_FILE"),
+		LogFileMaxSize:    env.int("LOG_FILE_MAX_SIZE_MB", d.LogFileMaxSize),
+		LogFileMaxBackups: env.int("LOG_FILE_MAX_BACKUPS", d.LogFileMaxBackups),
+		LogFileMaxAge:     env.int("LOG_FILE_MAX_AGE_DAYS", d.LogFileMaxAge),
+
+		DialTimeout:              env.duration("DIAL_TIMEOUT", d.DialTimeout),
+		HandshakeTimeout:         env.duration("HANDSHAKE_TIMEOUT", d.HandshakeTimeout),
+		ConfigWriteTimeout:       env.duration("CONFIG_WRITE_TIMEOUT", d.ConfigWriteTimeout),
+		ConfigWriteAttempts:      env.int("CONFIG_WRITE_ATTEMPTS", d.ConfigWriteAttempts),
+		DestinationTimeout:       d.DestinationTimeout,
+		StreamTimeout:            env.duration("STREAM_TIMEOUT", d.StreamTimeout),
+		UDPIdleTimeout:           env.duration("UDP_IDLE_TIMEOUT", d.UDPIdleTimeout),
+		TCPKeepAlive:             env.duration("TCP_KEEPALIVE", d.TCPKeepAlive),
+		TCPNoDelay:               env.bool("TCP_NODELAY", d.TCPNoDelay),
+		TunnelCompression:        env.bool("TUNNEL_COMPRESSION", d.TunnelCompression),
+		DSCP:                     env.int("DSCP", d.DSCP),
+		DestDialNetwork:          env.tcpNetwork("DEST_DIAL_NETWORK", d.DestDialNetwork),
+		GatewayDialNetwork:       env.tcpNetwork("GATEWAY_DIAL_NETWORK", d.GatewayDialNetwork),
+		GatewayIPOverride:        os.Getenv("GATEWAY_IP_OVERRIDE"),
+		EndpointsRefreshInterval: d.EndpointsRefreshInterval,
+
+		TunnelBackoffFactor:   env.float("TUNNEL_BACKOFF_FACTOR", d.TunnelBackoffFactor),
+		TunnelBackoffMin:      env.duration("TUNNEL_BACKOFF_MIN", d.TunnelBackoffMin),
+		TunnelBackoffMax:      env.duration("TUNNEL_BACKOFF_MAX", d.TunnelBackoffMax),
+		BackoffResetAfter:     env.duration("BACKOFF_RESET_AFTER", d.BackoffResetAfter),
+		ResolverBackoffFactor: env.float("RESOLVER_BACKOFF_FACTOR", d.ResolverBackoffFactor),
+		ResolverBackoffMin:    env.duration("RESOLVER_BACKOFF_MIN", d.ResolverBackoffMin),
+		ResolverBackoffMax:    env.duration("RESOLVER_BACKOFF_MAX", d.ResolverBackoffMax),
+
+		YamuxKeepAliveInterval: env.duration("YAMUX_KEEPALIVE_INTERVAL", d.YamuxKeepAliveInterval),
+		YamuxKeepAliveDisabled: os.Getenv("YAMUX_KEEPALIVE_DISABLED") == "true",
+		YamuxWriteTimeout:      env.duration("YAMUX_WRITE_TIMEOUT", d.YamuxWriteTimeout),
+		YamuxAcceptBacklog:     env.int("YAMUX_ACCEPT_BACKLOG", d.YamuxAcceptBacklog),
+		MaxConcurrentStreams:   env.int("MAX_CONCURRENT_STREAMS", d.MaxConcurrentStreams),
+		CopyBufferSize:         env.int("COPY_BUFFER_SIZE", d.CopyBufferSize),
+		GatewayReadTimeout:     env.duration("GATEWAY_READ_TIMEOUT", d.GatewayReadTimeout),
+		TunnelMaxIdle:          env.duration("TUNNEL_MAX_IDLE", d.TunnelMaxIdle),
+		TunnelMaxLifetime:      env.duration("TUNNEL_MAX_LIFETIME", d.TunnelMaxLifetime),
+		MaxStreamsPerSession:   env.int("MAX_STREAMS_PER_SESSION", d.MaxStreamsPerSession),
+		MakeBeforeBreak:        os.Getenv("MAKE_BEFORE_BREAK") == "true",
+		WarmStandby:            os.Getenv("WARM_STANDBY") == "true",
+		SessionsPerEndpoint:    env.int("SESSIONS_PER_ENDPOINT", d.SessionsPerEndpoint),
+		MinTunnels:             env.int("MIN_TUNNELS", d.MinTunnels),
+		MaxConcurrentConnects:  env.int("MAX_CONCURRENT_CONNECTS", d.MaxConcurrentConnects),
+
+		AllowedDestinations:  listEnv("ALLOWED_DESTINATIONS"),
+		SendProxyProtocol:    os.Getenv("SEND_PROXY_PROTOCOL") == "true",
+		MaxDestinationSize:   env.int("MAX_DESTINATION_SIZE", d.MaxDestinationSize),
+		MaxDestinationLabels: env.int("MAX_DESTINATION_LABELS", d.MaxDestinationLabels),
+		SourceAddress:        os.Getenv("SOURCE_ADDRESS"),
+		DestSocksProxy:       os.Getenv("DEST_SOCKS_PROXY"),
+		DestTLS:              os.Getenv("DEST_TLS") == "true",
+		DestTLSSkipVerify:    os.Getenv("DEST_TLS_SKIP_VERIFY") == "true",
+		DestTLSNextProtos:    listEnv("DEST_TLS_NEXT_PROTOS"),
+
+		BreakerThreshold: env.int("BREAKER_THRESHOLD", d.BreakerThreshold),
+		BreakerWindow:    env.duration("BREAKER_WINDOW", d.BreakerWindow),
+		BreakerCooldown:  env.duration("BREAKER_COOLDOWN", d.BreakerCooldown),
+		DestMaxRPS:       env.int("DEST_MAX_RPS", d.DestMaxRPS),
+
+		TLSDisabled:     os.Getenv("TLS_DISABLED") == "true",
+		TLSSkipVerify:   env.bool("TLS_SKIP_VERIFY", d.TLSSkipVerify),
+		TLSServerName:   os.Getenv("TLS_SERVER_NAME"),
+		TLSSessionCache: os.Getenv("TLS_SESSION_CACHE") == "true",
+		CertExpiryWarn:  env.duration("CERT_EXPIRY_WARN", d.CertExpiryWarn),
+
+		ResolverTokenHeader: d.ResolverTokenHeader,
+		ResolverTokenPrefix: os.Getenv("RESOLVER_TOKEN_PREFIX"),
+		ResolverUserAgent:   os.Getenv("RESOLVER_USER_AGENT"),
+		MaxResolverResponse: env.int("MAX_RESOLVER_RESPONSE", d.MaxResolverResponse),
+		EndpointsSeparator:  d.EndpointsSeparator,
+		StaticEndpoints:     listEnv("STATIC_ENDPOINTS"),
+
+		AuthFailureThreshold: env.int("AUTH_FAILURE_THRESHOLD", d.AuthFailureThreshold),
+		ExitOnAuthFailure:    os.Getenv("EXIT_ON_AUTH_FAILURE") == "true",
+		AllDownTimeout:       env.duration("ALL_DOWN_TIMEOUT", d.AllDownTimeout),
+		ExitOnAllDown:        os.Getenv("EXIT_ON_ALL_DOWN") == "true",
+		DrainTimeout:         env.duration("DRAIN_TIMEOUT", d.DrainTimeout),
+		SessionStatsInterval: env.duration("SESSION_STATS_INTERVAL", d.SessionStatsInterval),
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	if err := checkToken(cfg.Token); err != nil {
+		return nil, err
+	}
+	for _, u := range cfg.ResolverUrls {
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("invalid resolver URL %s: %s", u, err)
+		}
+		if cfg.TLSServerName == "" && !cfg.TLSSkipVerify && !cfg.TLSDisabled && serverNameFromURL(u) == "" {
+			return nil, fmt.Errorf("cannot derive the TLS server name of the gateways from the resolver URL %s, set TLS_SERVER_NAME", u)
+		}
+	}
+	if cfg.HealthCheckURL != "" {
+		if u, err := url.Parse(cfg.HealthCheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid HEALTH_CHECK_URL: %s", cfg.HealthCheckURL)
+		}
+	}
+	if cfg.DSCP < -1 || cfg.DSCP > 63 {
+		return nil, fmt.Errorf("invalid DSCP: %d, must be between 0 and 63", cfg.DSCP)
+	}
+	if cfg.ConfigWriteAttempts < 1 {
+		return nil, fmt.Errorf("invalid CONFIG_WRITE_ATTEMPTS: %d", cfg.ConfigWriteAttempts)
+	}
+	if cfg.YamuxAcceptBacklog < 1 {
+		return nil, fmt.Errorf("invalid YAMUX_ACCEPT_BACKLOG: %d", cfg.YamuxAcceptBacklog)
+	}
+	if cfg.CopyBufferSize < 1 {
+		return nil, fmt.Errorf("invalid COPY_BUFFER_SIZE: %d", cfg.CopyBufferSize)
+	}
+	if cfg.SessionsPerEndpoint < 1 {
+		return nil, fmt.Errorf("invalid SESSIONS_PER_ENDPOINT: %d", cfg.SessionsPerEndpoint)
+	}
+	if err := checkBackoff("TUNNEL_BACKOFF", cfg.TunnelBackoffFactor, cfg.TunnelBackoffMin, cfg.TunnelBackoffMax); err != nil {
+		return nil, err
+	}
+	if err := checkBackoff("RESOLVER_BACKOFF", cfg.ResolverBackoffFactor, cfg.ResolverBackoffMin, cfg.ResolverBackoffMax); err != nil {
+		return nil, err
+	}
+	if header := os.Getenv("RESOLVER_TOKEN_HEADER"); header != "" {
+		cfg.ResolverTokenHeader = header
+	}
+	if sep := os.Getenv("ENDPOINTS_SEPARATOR"); sep != "" {
+		// the escaped forms make it possible to pass a newline or a tab without quoting tricks
+		cfg.EndpointsSeparator = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(sep)
+	}
+	if os.Getenv("DEBUG") == "true" && cfg.LogLevel < 4 {
+		cfg.LogLevel = 4
+	}
+	for _, p := range listEnv("ALLOWED_PORTS") {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in ALLOWED_PORTS: %s", p)
+		}
+		cfg.AllowedPorts = append(cfg.AllowedPorts, port)
+	}
+	sort.Ints(cfg.AllowedPorts)
+	for _, h := range listEnv("RESOLVER_HEADERS") {
+		name, value, _ := strings.Cut(h, "=")
+		name = strings.TrimSpace(name)
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name in RESOLVER_HEADERS: %q", name)
+		}
+		if cfg.ResolverHeaders == nil {
+			cfg.ResolverHeaders = map[string]string{}
+		}
+		cfg.ResolverHeaders[name] = strings.TrimSpace(value)
+	}
+	for _, l := range listEnv("AGENT_LABELS") {
+		name, value, _ := strings.Cut(l, "=")
+		if name = strings.TrimSpace(name); name == "" {
+			return nil, fmt.Errorf("invalid label in AGENT_LABELS: %q", l)
+		}
+		if cfg.AgentLabels == nil {
+			cfg.AgentLabels = map[string]string{}
+		}
+		cfg.AgentLabels[name] = strings.TrimSpace(value)
+	}
+	if data, _ := json.Marshal(cfg.AgentLabels); len(cfg.AgentLabels) > 0 && len(data) > maxAgentLabelsSize {
+		return nil, fmt.Errorf("AGENT_LABELS exceed %d bytes", maxAgentLabelsSize)
+	}
+	for _, r := range listEnv("DEST_TIMEOUTS") {
+		pattern, value, _ := strings.Cut(r, "=")
+		pattern = strings.TrimSpace(pattern)
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if _, perr := path.Match(pattern, ""); pattern == "" || perr != nil || err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid rule in DEST_TIMEOUTS: %q, expected host-pattern=duration", r)
+		}
+		cfg.DestTimeouts = append(cfg.DestTimeouts, DestTimeout{Pattern: pattern, Timeout: Duration(d)})
+	}
+	for _, t := range listEnv("TARGETS") {
+		name, addr, _ := strings.Cut(t, "=")
+		name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); name == "" || err != nil {
+			return nil, fmt.Errorf("invalid target in TARGETS: %q, expected name=host:port", t)
+		}
+		if cfg.Targets == nil {
+			cfg.Targets = map[string]string{}
+		}
+		cfg.Targets[name] = addr
+	}
+	if cfg.SourceAddress != "" && net.ParseIP(cfg.SourceAddress) == nil {
+		return nil, fmt.Errorf("invalid SOURCE_ADDRESS: %s", cfg.SourceAddress)
+	}
+	for _, s := range listEnv("DNS_SERVERS") {
+		if ip := net.ParseIP(s); ip != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server in DNS_SERVERS: %q, expected ip or ip:port", s)
+		}
+		cfg.DNSServers = append(cfg.DNSServers, s)
+	}
+	if cfg.LocalProxyCheck != "" {
+		u, err := url.Parse(cfg.LocalProxyCheck)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid LOCAL_PROXY_CHECK: %s, expected an http(s) URL", cfg.LocalProxyCheck)
+		}
+	}
+	if cfg.GatewayIPOverride != "" && net.ParseIP(cfg.GatewayIPOverride) == nil {
+		return nil, fmt.Errorf("invalid GATEWAY_IP_OVERRIDE: %s, expected an IP address", cfg.GatewayIPOverride)
+	}
+	if cfg.DestSocksProxy != "" {
+		u, err := url.Parse(cfg.DestSocksProxy)
+		if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+			return nil, fmt.Errorf("invalid DEST_SOCKS_PROXY: %s, expected socks5://[user:password@]host:port", cfg.DestSocksProxy)
+		}
+	}
+	if !cfg.DestTLS && (cfg.DestTLSSkipVerify || len(cfg.DestTLSNextProtos) > 0) {
+		return nil, fmt.Errorf("DEST_TLS_SKIP_VERIFY and DEST_TLS_NEXT_PROTOS require DEST_TLS")
+	}
+	return cfg, nil
+}
+
+// settings holds the effective settings of an agent in the form used by its tunnels, proxies and resolver,
+// along with the state derived from them and shared by the tunnels, such as the connect slots.
+type settings struct {
+	dialTimeout         time.Duration
+	handshakeTimeout    time.Duration
+	configWriteTimeout  time.Duration
+	configWriteAttempts int
+	timeout             time.Duration
+	destTimeouts        []DestTimeout
+	breakerThreshold    int
+	breakerWindow       time.Duration
+	breakerCooldown     time.Duration
+	// rateLimiter limits the streams to each destination to DEST_MAX_RPS across all the tunnels.
+	rateLimiter              *rateLimiter
+	streamTimeout            time.Duration
+	udpIdleTimeout           time.Duration
+	tcpKeepAlive             time.Duration
+	tcpNoDelay               bool
+	tunnelCompression        bool
+	agentLabels              map[string]string
+	dscp                     int
+	destDialNetwork          string
+	gatewayDialNetwork       string
+	gatewayIPOverride        string
+	endpointsRefreshInterval time.Duration
+
+	backoffFactor         float64
+	backoffMin            time.Duration
+	backoffMax            time.Duration
+	backoffResetAfter     time.Duration
+	resolverBackoffFactor float64
+	resolverBackoffMin    time.Duration
+	resolverBackoffMax    time.Duration
+
+	yamuxKeepAliveInterval time.Duration
+	yamuxKeepAliveDisabled bool
+	yamuxWriteTimeout      time.Duration
+	yamuxAcceptBacklog     int
+	maxConcurrentStreams   int
+	copyBufferSize         int
+	gatewayReadTimeout     time.Duration
+	tunnelMaxIdle          time.Duration
+	tunnelMaxLifetime      time.Duration
+	maxStreamsPerSession   int
+	makeBeforeBreak        bool
+	warmStandby            bool
+	sessionsPerEndpoint    int
+	minTunnels             int
+	// connectSlots limits the number of concurrent handshakes if MAX_CONCURRENT_CONNECTS is set,
+	// so that a large fleet of gateways isn't dialed all at once.
+	connectSlots chan struct{}
+
+	allowedDestinations []string
+	allowedPorts        map[int]bool
+	targets             map[string]string
+	sendProxyProtocol   bool
+	maxDestinationSize  int
+	// destinations bounds the values of the destination label of the metrics to MAX_DESTINATION_LABELS.
+	destinations      *destinationLabels
+	sourceAddress     net.Addr
+	destSocksProxy    string
+	destTLS           bool
+	destTLSSkipVerify bool
+	destTLSNextProtos []string
+	dnsResolver       *net.Resolver
+
+	tlsDisabled     bool
+	tlsSkipVerify   bool
+	tlsServerName   string
+	tlsSessionCache tls.ClientSessionCache
+	certExpiryWarn  time.Duration
+
+	resolverTokenHeader string
+	resolverTokenPrefix string
+	resolverUserAgent   string
+	resolverHeaders     map[string]string
+	maxResolverResponse int
+	endpointsSeparator  string
+	staticEndpoints     []string
+
+	authFailureThreshold int
+	exitOnAuthFailure    bool
+	allDownTimeout       time.Duration
+	exitOnAllDown        bool
+	drainTimeout         time.Duration
+	sessionStatsInterval time.Duration
+}
+
+// settings returns the settings in effect for an agent created with the config.
+func (c *Config) settings() *settings {
+	s := &settings{
+		dialTimeout:         time.Duration(c.DialTimeout),
+		handshakeTimeout:    time.Duration(c.HandshakeTimeout),
+		configWriteTimeout:  time.Duration(c.ConfigWriteTimeout),
+		configWriteAttempts: c.ConfigWriteAttempts,
+		timeout:             time.Duration(c.DestinationTimeout),
+		destTimeouts:        c.DestTimeouts,
+		breakerThreshold:    c.BreakerThreshold,
+		breakerWindow:       time.Duration(c.BreakerWindow),
+		breakerCooldown:     time.Duration(c.BreakerCooldown),
+		rateLimiter:         newRateLimiter(c.DestMaxRPS),
+		streamTimeout:       time.Duration(c.StreamTimeout),
+		udpIdleTimeout:      time.Duration(c.UDPIdleTimeout),
+		tcpKeepAlive:        time.Duration(c.TCPKeepAlive),
+		tcpNoDelay:          c.TCPNoDelay,
+		tunnelCompression:   c.TunnelCompression,
+		agentLabels:         c.AgentLabels,
+		dscp:                c.DSCP,
+		destDialNetwork:     c.DestDialNetwork,
+		gatewayDialNetwork:  c.GatewayDialNetwork,
+		gatewayIPOverride:   c.GatewayIPOverride,
+
+		endpointsRefreshInterval: time.Duration(c.EndpointsRefreshInterval),
+
+		backoffFactor:         c.TunnelBackoffFactor,
+		backoffMin:            time.Duration(c.TunnelBackoffMin),
+		backoffMax:            time.Duration(c.TunnelBackoffMax),
+		backoffResetAfter:     time.Duration(c.BackoffResetAfter),
+		resolverBackoffFactor: c.ResolverBackoffFactor,
+		resolverBackoffMin:    time.Duration(c.ResolverBackoffMin),
+		resolverBackoffMax:    time.Duration(c.ResolverBackoffMax),
+
+		yamuxKeepAliveInterval: time.Duration(c.YamuxKeepAliveInterval),
+		yamuxKeepAliveDisabled: c.YamuxKeepAliveDisabled,
+		yamuxWriteTimeout:      time.Duration(c.YamuxWriteTimeout),
+		yamuxAcceptBacklog:     c.YamuxAcceptBacklog,
+		maxConcurrentStreams:   c.MaxConcurrentStreams,
+		copyBufferSize:         c.CopyBufferSize,
+		gatewayReadTimeout:     time.Duration(c.GatewayReadTimeout),
+		tunnelMaxIdle:          time.Duration(c.TunnelMaxIdle),
+		tunnelMaxLifetime:      time.Duration(c.TunnelMaxLifetime),
+		maxStreamsPerSession:   c.MaxStreamsPerSession,
+		makeBeforeBreak:        c.MakeBeforeBreak,
+		warmStandby:            c.WarmStandby,
+		sessionsPerEndpoint:    c.SessionsPerEndpoint,
+		minTunnels:             c.MinTunnels,
+
+		allowedDestinations: c.AllowedDestinations,
+		targets:             c.Targets,
+		sendProxyProtocol:   c.SendProxyProtocol,
+		maxDestinationSize:  c.MaxDestinationSize,
+		destinations:        newDestinationLabels(c.MaxDestinationLabels),
+		destSocksProxy:      c.DestSocksProxy,
+		destTLS:             c.DestTLS,
+		destTLSSkipVerify:   c.DestTLSSkipVerify,
+		destTLSNextProtos:   c.DestTLSNextProtos,
+		dnsResolver:         net.DefaultResolver,
+
+		tlsDisabled:    c.TLSDisabled,
+		tlsSkipVerify:  c.TLSSkipVerify,
+		tlsServerName:  c.TLSServerName,
+		certExpiryWarn: time.Duration(c.CertExpiryWarn),
+
+		resolverTokenHeader: c.ResolverTokenHeader,
+		resolverTokenPrefix: c.ResolverTokenPrefix,
+		resolverUserAgent:   c.ResolverUserAgent,
+		resolverHeaders:     c.ResolverHeaders,
+		maxResolverResponse: c.MaxResolverResponse,
+		endpointsSeparator:  c.EndpointsSeparator,
+		staticEndpoints:     c.StaticEndpoints,
+
+		authFailureThreshold: c.AuthFailureThreshold,
+		exitOnAuthFailure:    c.ExitOnAuthFailure,
+		allDownTimeout:       time.Duration(c.AllDownTimeout),
+		exitOnAllDown:        c.ExitOnAllDown,
+		drainTimeout:         time.Duration(c.DrainTimeout),
+		sessionStatsInterval: time.Duration(c.SessionStatsInterval),
+	}
+	if c.MaxConcurrentConnects > 0 {
+		s.connectSlots = make(chan struct{}, c.MaxConcurrentConnects)
+	}
+	for _, p := range c.AllowedPorts {
+		if s.allowedPorts == nil {
+			s.allowedPorts = map[int]bool{}
+		}
+		s.allowedPorts[p] = true
+	}
+	if c.SourceAddress != "" {
+		s.sourceAddress = &net.TCPAddr{IP: net.ParseIP(c.SourceAddress)}
+	}
+	if len(c.DNSServers) > 0 {
+		s.dnsResolver = newDNSResolver(c.DNSServers)
+	}
+	if c.TLSSessionCache {
+		// sessions are cached per server name (or address if there is none)
+		s.tlsSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return s
+}
+
+// checkToken validates that the project token is a UUID in its canonical form.
+// The token itself isn't included in the errors, since they are logged.
+func checkToken(token string) error {
+	const format = "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	invalid := func(reason string, args ...interface{}) error {
+		return fmt.Errorf("invalid PROJECT_TOKEN: %s, expected a UUID (%s)", fmt.Sprintf(reason, args...), format)
+	}
+	if len(token) != len(format) {
+		return invalid("%d characters long", len(token))
+	}
+	for i, c := range token {
+		switch {
+		case format[i] == '-':
+			if c != '-' {
+				return invalid("no hyphen at position %d", i+1)
+			}
+		case !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'):
+			return invalid("non-hex character at position %d", i+1)
+		}
+	}
+	return nil
+}
+
+// checkBackoff validates the backoff settings of the given env prefix.
+func checkBackoff(prefix string, factor float64, min, max Duration) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid %s_FACTOR: %g, must be at least 1", prefix, factor)
+	}
+	if min <= 0 {
+		return fmt.Errorf("invalid %s_MIN: %s, must be positive", prefix, time.Duration(min))
+	}
+	if max < min {
+		return fmt.Errorf("invalid %s_MAX: %s, must not be less than %s_MIN", prefix, time.Duration(max), prefix)
+	}
+	return nil
+}
+
+// envReader parses environment variables, keeping the first error to be checked once all of them are read.
+type envReader struct {
+	err error
+}
+
+func (r *envReader) required(key string) string {
+	value := os.Getenv(key)
+	if value == "" && r.err == nil {
+		r.err = fmt.Errorf("%s environment variable is required", key)
+	}
+	return value
+}
+
+func (r *envReader) int(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return i
+}
+
+func (r *envReader) bool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return b
+}
+
+func (r *envReader) float(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return f
+}
+
+func (r *envReader) tcpNetwork(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	switch value {
+	case "":
+		return defaultValue
+	case "tcp", "tcp4", "tcp6":
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid %s: %s, expected tcp, tcp4, or tcp6", key, value)
+		}
+	}
+	return value
+}
+
+func (r *envReader) duration(key string, defaultValue Duration) Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return Duration(d)
+}
+
+// Redacted returns a copy of the config safe to expose: the token is masked,
+// as well as the passwords in the resolver URLs and the values of the resolver headers.
+func (c Config) Redacted() Config {
+	if c.Token != "" {
+		c.Token = "<redacted>"
+	}
+	urls := make([]string, 0, len(c.ResolverUrls))
+	for _, u := range c.ResolverUrls {
+		if parsed, err := url.Parse(u); err == nil {
+			u = parsed.Redacted()
+		}
+		urls = append(urls, u)
+	}
+	c.ResolverUrls = urls
+	if parsed, err := url.Parse(c.HealthCheckURL); err == nil {
+		c.HealthCheckURL = parsed.Redacted()
+	}
+	if parsed, err := url.Parse(c.DestSocksProxy); err == nil {
+		c.DestSocksProxy = parsed.Redacted()
+	}
+	if len(c.ResolverHeaders) > 0 {
+		headers := make(map[string]string, len(c.ResolverHeaders))
+		for name := range c.ResolverHeaders {
+			headers[name] = "<redacted>"
+		}
+		c.ResolverHeaders = headers
+	}
+	return c
+}
+
+// validHeaderName reports whether the name consists of the token characters allowed by RFC 7230.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,169 +1,965 @@
-package main
+package connect
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/hashicorp/yamux"
 	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
 	"k8s.io/klog"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	version                  = "unknown"
-	timeout                  = 10 * time.Second
-	tlsSkipVerify            = false
-	endpointsRefreshInterval = 10 * time.Minute
-	backoffFactor            = 2.
-	backoffMin               = 5 * time.Second
-	backoffMax               = time.Minute
-	streamTimeout            = 5 * time.Minute
+	version            = "unknown"
+	defaultResolverUrl = "https://gw.coroot.com/connect/resolve"
+	maxAgentLabelsSize = 1024
 )
 
+// Tunnel maintains the sessions to a gateway and proxies the streams the gateway opens through them.
 type Tunnel struct {
+	agent      *Agent
+	settings   *settings
 	address    string
 	serverName string
+	hints      map[string]string
 	token      string
 	config     []byte
 	cancelFn   context.CancelFunc
-	gwConn     net.Conn
+	proxy      *Proxy
+	sessions   sync.WaitGroup
+
+	lock sync.Mutex
+	// gwConns holds the current connection of each of the sessions to the gateway, nil if disconnected.
+	gwConns []net.Conn
+	// draining holds the connections replaced by MAKE_BEFORE_BREAK until their active streams complete.
+	draining map[net.Conn]bool
+	closed   bool
+	// stats holds the last sampled stats of each of the connected sessions.
+	stats []*SessionStats
+	// healthyAt is when a session was last connected, used to pick the tunnels kept for MIN_TUNNELS.
+	healthyAt   time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// TunnelStatus describes the state of a tunnel in the /tunnels response.
+type TunnelStatus struct {
+	Gateway           string     `json:"gateway"`
+	ServerName        string     `json:"server_name"`
+	Sessions          int        `json:"sessions"`
+	ConnectedSessions int        `json:"connected_sessions"`
+	ActiveStreams     int64      `json:"active_streams"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+	// SessionStats is indexed by session, null for the sessions that haven't been sampled since they connected.
+	SessionStats []*SessionStats `json:"session_stats"`
+}
+
+// tunnelRegistry keeps track of the open tunnels to report their state.
+type tunnelRegistry struct {
+	lock    sync.Mutex
+	tunnels map[*Tunnel]bool
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: map[*Tunnel]bool{}}
+}
+
+func (r *tunnelRegistry) add(t *Tunnel) {
+	r.lock.Lock()
+	r.tunnels[t] = true
+	r.lock.Unlock()
+}
+
+func (r *tunnelRegistry) remove(t *Tunnel) {
+	r.lock.Lock()
+	delete(r.tunnels, t)
+	r.lock.Unlock()
 }
 
-func NewTunnel(address, serverName string, token string, config []byte) *Tunnel {
+func (r *tunnelRegistry) status() []TunnelStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make([]TunnelStatus, 0, len(r.tunnels))
+	for t := range r.tunnels {
+		res = append(res, t.status())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Gateway < res[j].Gateway
+	})
+	return res
+}
+
+// newTunnel creates a tunnel of the agent passing the routing hints of the endpoint to the gateway.
+func (a *Agent) newTunnel(address, serverName string, token string, config []byte, hints map[string]string) *Tunnel {
 	t := &Tunnel{
+		agent:      a,
+		settings:   a.settings,
 		address:    address,
 		serverName: serverName,
+		hints:      hints,
 		token:      token,
 		config:     config,
+		proxy:      newProxy(a.settings),
+		gwConns:    make([]net.Conn, a.settings.sessionsPerEndpoint),
+		draining:   map[net.Conn]bool{},
+		stats:      make([]*SessionStats, a.settings.sessionsPerEndpoint),
 	}
+	t.proxy.onStats = t.recordStats
 	var ctx context.Context
 	ctx, t.cancelFn = context.WithCancel(context.Background())
-	go t.keepConnected(ctx)
+	a.tunnels.add(t)
+	for i := range t.gwConns {
+		t.sessions.Add(1)
+		go func(i int) {
+			defer t.sessions.Done()
+			t.keepConnected(ctx, i)
+		}(i)
+	}
 	return t
 }
 
-func (t *Tunnel) keepConnected(ctx context.Context) {
-	b := backoff.Backoff{Factor: backoffFactor, Min: backoffMin, Max: backoffMax}
+func (t *Tunnel) setConn(i int, gwConn net.Conn) {
+	t.lock.Lock()
+	if gwConn != nil || t.gwConns[i] != nil {
+		t.healthyAt = time.Now()
+	}
+	t.gwConns[i] = gwConn
+	t.stats[i] = nil
+	session := strconv.Itoa(i)
+	sessionStreams.DeleteLabelValues(t.address, t.serverName, session)
+	sessionRTT.DeleteLabelValues(t.address, t.serverName, session)
+	t.lock.Unlock()
+}
+
+// recordStats stores the stats of the session served over gwConn unless it has already been replaced.
+func (t *Tunnel) recordStats(gwConn net.Conn, stats SessionStats) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, c := range t.gwConns {
+		if c == gwConn {
+			t.stats[i] = &stats
+			session := strconv.Itoa(i)
+			sessionStreams.WithLabelValues(t.address, t.serverName, session).Set(float64(stats.Streams))
+			sessionRTT.WithLabelValues(t.address, t.serverName, session).Set(time.Duration(stats.RTT).Seconds())
+		}
+	}
+}
+
+// lastHealthy returns when the tunnel was last connected, now if it is.
+func (t *Tunnel) lastHealthy() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, c := range t.gwConns {
+		if c != nil {
+			return time.Now()
+		}
+	}
+	return t.healthyAt
+}
+
+func (t *Tunnel) setLastError(err error) {
+	t.lock.Lock()
+	t.lastError = err.Error()
+	t.lastErrorAt = time.Now()
+	t.lock.Unlock()
+}
+
+func (t *Tunnel) status() TunnelStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := TunnelStatus{Gateway: t.address, ServerName: t.serverName, Sessions: len(t.gwConns), LastError: t.lastError}
+	s.ActiveStreams = t.proxy.ActiveStreams()
+	s.SessionStats = append([]*SessionStats{}, t.stats...)
+	for _, c := range t.gwConns {
+		if c != nil {
+			s.ConnectedSessions++
+		}
+	}
+	if !t.lastErrorAt.IsZero() {
+		at := t.lastErrorAt
+		s.LastErrorAt = &at
+	}
+	return s
+}
+
+// keepConnected maintains the i-th session to the gateway.
+// The streams are opened by the gateway, which picks the session of each of them, so the agent can't steer a stream to a session.
+func (t *Tunnel) keepConnected(ctx context.Context, i int) {
+	b := backoff.Backoff{Factor: t.settings.backoffFactor, Min: t.settings.backoffMin, Max: t.settings.backoffMax}
+	var gwConn, next net.Conn
 	var err error
+	var sb *standby
+	defer func() {
+		sb.close()
+	}()
 	for {
 		select {
 		case <-ctx.Done():
+			if next != nil {
+				_ = next.Close()
+			}
 			return
 		default:
-			t.gwConn, err = connect(t.address, t.serverName, t.token, t.config)
+			if next != nil {
+				gwConn, next = next, nil
+			} else if c := sb.take(); c != nil {
+				klog.Infof("promoting the standby connection to %s", t.address)
+				gwConn, err = c, nil
+				sb = t.startStandby(ctx)
+			} else {
+				if !t.settings.acquireConnectSlot(ctx) {
+					return
+				}
+				reconnectAttempts.WithLabelValues(t.address, t.serverName).Inc()
+				gwConn, err = t.settings.connectWithHints(t.address, t.serverName, t.token, t.config, t.hints)
+				t.settings.releaseConnectSlot()
+				if err != nil {
+					reconnectFailures.WithLabelValues(t.address, t.serverName).Inc()
+				}
+			}
+			flapping := false
+			var he *HandshakeError
+			switch {
+			case err == nil:
+				t.agent.authFailures.reset()
+			case errors.As(err, &he) && he.AuthFailed():
+				t.agent.authFailures.rejected()
+			}
+			if err == nil && ctx.Err() != nil {
+				// the tunnel has been closed during the handshake
+				_ = gwConn.Close()
+				return
+			}
 			if err == nil {
+				t.setConn(i, gwConn)
+				if t.settings.warmStandby && sb == nil {
+					sb = t.startStandby(ctx)
+				}
+				tunnelUp.WithLabelValues(t.address, t.serverName).Inc()
+				reconnectBackoff.WithLabelValues(t.address, t.serverName).Set(0)
 				start := time.Now()
-				err = proxy(ctx, t.gwConn)
-				_ = t.gwConn.Close()
-				if time.Since(start) > b.Max {
+				next, err = t.serve(ctx, gwConn)
+				recycled := err == errTunnelIdle || err == errSessionRecycled
+				switch err {
+				case errTunnelIdle:
+					klog.Infof("no streams from %s within %s, recycling the connection", t.address, t.settings.tunnelMaxIdle)
+					err = nil
+				case errSessionRecycled:
+					klog.Infof("the connection to %s has served %d streams, reconnecting", t.address, t.settings.maxStreamsPerSession)
+					err = nil
+				case errGatewayGoAway:
+					klog.Infof("%s has drained the connection, reconnecting", t.address)
+					err = nil
+				}
+				if next == nil {
+					t.setConn(i, nil)
+				}
+				tunnelUp.WithLabelValues(t.address, t.serverName).Dec()
+				// the backoff is reset only for a connection that has stayed up long enough or was recycled by the agent,
+				// so that reconnecting to a gateway dropping the connections right away is still delayed
+				if recycled || next != nil || time.Since(start) >= t.settings.backoffResetAfter {
 					b.Reset()
+				} else if err == nil {
+					flapping = true
 				}
 			}
-			if err != nil {
-				klog.Errorln(err)
+			if err != nil || flapping {
+				if err != nil {
+					klog.Errorln(err)
+					t.setLastError(err)
+				}
+				if sb.ready() {
+					continue
+				}
 				d := b.Duration()
+				reconnectBackoff.WithLabelValues(t.address, t.serverName).Set(d.Seconds())
 				klog.Infof("reconnecting to %s in %.0fs", t.address, d.Seconds())
-				time.Sleep(d)
-				continue
+				select {
+				case <-ctx.Done():
+				case <-time.After(d):
+				}
+			}
+		}
+	}
+}
+
+// standby is a connection to the gateway that has completed the handshake but isn't served until promoted,
+// so that the session is restored without reconnecting once the active connection drops.
+// The connection is watched while on standby and replaced if the gateway closes it.
+type standby struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	closed  bool
+	watched chan []byte // receives the data read from conn by the watcher once it has exited
+}
+
+// startStandby establishes a standby connection in the background, retrying with a backoff until it succeeds
+// or the context is canceled, and reestablishes it whenever it drops before being taken.
+func (t *Tunnel) startStandby(ctx context.Context) *standby {
+	s := &standby{}
+	t.sessions.Add(1)
+	go func() {
+		defer t.sessions.Done()
+		b := backoff.Backoff{Factor: t.settings.backoffFactor, Min: t.settings.backoffMin, Max: t.settings.backoffMax}
+		for {
+			if !t.settings.acquireConnectSlot(ctx) {
+				return
 			}
-			b.Reset()
+			conn, err := t.settings.connectWithHints(t.address, t.serverName, t.token, t.config, t.hints)
+			t.settings.releaseConnectSlot()
+			if err == nil {
+				watched := s.set(ctx, conn)
+				if watched == nil {
+					return
+				}
+				klog.Infof("established a standby connection to %s", t.address)
+				if s.watch(conn, watched) {
+					return
+				}
+				klog.Warningf("the standby connection to %s has been closed, reconnecting", t.address)
+			} else {
+				klog.Warningf("failed to establish a standby connection to %s: %s", t.address, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(b.Duration()):
+			}
+		}
+	}()
+	return s
+}
+
+// set makes conn the standby connection. It returns nil if the standby has been closed meanwhile.
+func (s *standby) set(ctx context.Context, conn net.Conn) chan []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || ctx.Err() != nil {
+		_ = conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.watched = make(chan []byte, 1)
+	return s.watched
+}
+
+// watch reads from the standby connection until it fails, which happens when the gateway closes the connection
+// or when the connection is taken or closed. It returns false in the former case.
+// The data read is kept for take, so that nothing the gateway sends while on standby is lost.
+// A compressed connection is watched below the decompressor, since an interrupted read would break the latter.
+func (s *standby) watch(conn net.Conn, watched chan<- []byte) bool {
+	raw := conn
+	if c, ok := conn.(*compressedConn); ok {
+		raw = c.Conn
+	}
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := raw.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if err == nil {
+			continue
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.conn != conn {
+			watched <- pending
+			return true
+		}
+		_ = conn.Close()
+		s.conn = nil
+		return false
+	}
+}
+
+// ready reports whether the standby connection is established.
+func (s *standby) ready() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn != nil
+}
+
+// take returns the standby connection if it is established, nil otherwise.
+// The watcher is interrupted with a read deadline, and the data it has read is returned ahead of the rest.
+func (s *standby) take() net.Conn {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	conn, watched := s.conn, s.watched
+	s.conn = nil
+	if conn != nil {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.lock.Unlock()
+	if conn == nil {
+		return nil
+	}
+	pending := <-watched
+	_ = conn.SetReadDeadline(time.Time{})
+	if len(pending) == 0 {
+		return conn
+	}
+	if c, ok := conn.(*compressedConn); ok {
+		return newCompressedConn(&prefixedConn{Conn: c.Conn, prefix: pending})
+	}
+	return &prefixedConn{Conn: conn, prefix: pending}
+}
+
+// prefixedConn returns the data read from the connection in advance before reading from the connection itself.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// close closes the standby connection, including the one being established.
+func (s *standby) close() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// acquireConnectSlot waits for a free slot and returns false if the context is canceled meanwhile.
+func (s *settings) acquireConnectSlot(ctx context.Context) bool {
+	if s.connectSlots == nil {
+		return true
+	}
+	select {
+	case s.connectSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *settings) releaseConnectSlot() {
+	if s.connectSlots != nil {
+		<-s.connectSlots
+	}
+}
+
+// serve proxies the streams of the gateway connection until the session fails or reaches tunnelMaxLifetime.
+// In the latter case, if makeBeforeBreak is set, a replacement connection is established before draining the current one,
+// which completes in the background, and the replacement is returned to be served next.
+func (t *Tunnel) serve(ctx context.Context, gwConn net.Conn) (net.Conn, error) {
+	tracker := t.agent.connected
+	tracker.up()
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := t.proxy.Serve(serveCtx, gwConn)
+		_ = gwConn.Close()
+		tracker.down()
+		done <- err
+	}()
+	var expired <-chan time.Time
+	if t.settings.tunnelMaxLifetime > 0 {
+		timer := time.NewTimer(t.settings.tunnelMaxLifetime)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-done:
+		return nil, err
+	case <-expired:
+	}
+	klog.Infof("the connection to %s has reached the max lifetime of %s", t.address, t.settings.tunnelMaxLifetime)
+	if t.settings.makeBeforeBreak && t.settings.acquireConnectSlot(ctx) {
+		next, err := t.settings.connectWithHints(t.address, t.serverName, t.token, t.config, t.hints)
+		t.settings.releaseConnectSlot()
+		if err == nil {
+			t.drainInBackground(gwConn, done)
+			return next, nil
 		}
+		klog.Errorf("failed to establish a replacement connection, draining the current one anyway: %s", err)
+	}
+	cancel()
+	return nil, <-done
+}
+
+// drainInBackground keeps track of the replaced connection until serving it is done, so that closing the tunnel closes it too.
+func (t *Tunnel) drainInBackground(gwConn net.Conn, done <-chan error) {
+	t.lock.Lock()
+	if t.closed {
+		_ = gwConn.Close()
+	} else {
+		t.draining[gwConn] = true
 	}
+	t.lock.Unlock()
+	t.sessions.Add(1)
+	go func() {
+		defer t.sessions.Done()
+		<-done
+		t.lock.Lock()
+		delete(t.draining, gwConn)
+		t.lock.Unlock()
+	}()
+}
+
+// Drain stops the sessions gracefully: the gateway is asked not to open new streams,
+// and Drain returns once the active ones complete.
+func (t *Tunnel) Drain() {
+	t.cancelFn()
+	t.sessions.Wait()
 }
 
+// Close closes the sessions and returns once their goroutines have exited.
 func (t *Tunnel) Close() {
 	t.cancelFn()
-	if t.gwConn != nil {
-		_ = t.gwConn.Close()
+	t.lock.Lock()
+	t.closed = true
+	for _, c := range t.gwConns {
+		if c != nil {
+			_ = c.Close()
+		}
+	}
+	for c := range t.draining {
+		_ = c.Close()
 	}
+	t.lock.Unlock()
+	t.sessions.Wait() // the metrics are deleted once nothing can update them anymore
+	t.agent.tunnels.remove(t)
+	deleteTunnelMetrics(t.address)
 }
 
-func main() {
-	resolverUrl := os.Getenv("RESOLVER_URL")
-	if resolverUrl == "" {
-		resolverUrl = "https://gw.coroot.com/connect/resolve"
+// Main runs the agent configured by the command line flags and the environment variables until it is drained.
+func Main() {
+	start := time.Now()
+	validateOnly := flag.Bool("validate", false, "validate the configuration and the resolver response, then exit")
+	validateHandshake := flag.Bool("validate-handshake", false, "also perform a handshake with one of the gateways in the validate mode")
+	diagnoseOnly := flag.Bool("diagnose", false, "check the connectivity to the resolver and the gateways step by step, print the results, then exit")
+	flag.Parse()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		klog.Exitln(err)
+	}
+	if cfg.ValidateOnly {
+		*validateOnly = true
 	}
-	token := mustEnv("PROJECT_TOKEN")
-	if len(token) != 36 {
-		klog.Exitln("invalid project token")
+	if err := setLogLevel(cfg.LogLevel); err != nil {
+		klog.Exitln("invalid LOG_LEVEL:", err)
+	}
+	if cfg.LogFile != "" {
+		logFile := &lumberjack.Logger{
+			Filename:   cfg.LogFile,
+			MaxSize:    cfg.LogFileMaxSize,
+			MaxBackups: cfg.LogFileMaxBackups,
+			MaxAge:     cfg.LogFileMaxAge,
+		}
+		defer logFile.Close()
+		if err := setLogFile(logFile); err != nil {
+			klog.Exitln("failed to set up LOG_FILE:", err)
+		}
 	}
-	configPath := mustEnv("CONFIG_PATH")
+	token, resolverUrls, configPath := cfg.Token, cfg.ResolverUrls, cfg.ConfigPath
 
-	data, err := os.ReadFile(configPath)
+	config, err := readConfig(configPath)
 	if err != nil {
 		klog.Exitln("failed to read config:", err)
 	}
-	config := []byte(os.ExpandEnv(string(data)))
+	agent := newAgent(cfg, config)
+	s := agent.settings
+	if _, ok := s.handshakeVersion(); s.tunnelCompression && !ok {
+		klog.Warningf("TUNNEL_COMPRESSION can't be advertised to the gateways with the version %q longer than %d bytes, the tunnels won't be compressed",
+			version, len(RequestHeader{}.Version)-len(compressionVersionSuffix))
+	}
+	if s.tlsDisabled {
+		klog.Warningln("TLS is disabled, the tunnels are neither encrypted nor authenticated, never use TLS_DISABLED outside of local testing")
+	}
+	s.logMemoryBound()
+	if s.yamuxKeepAliveDisabled {
+		klog.Warningln("yamux keepalive is disabled, idle gateway connections can be closed by GATEWAY_READ_TIMEOUT")
+	}
 
 	klog.Infof("version: %s", version)
+	registerBuildInfo(prometheus.DefaultRegisterer, start)
+	if !cfg.RuntimeMetrics {
+		unregisterRuntimeMetrics(prometheus.DefaultRegisterer)
+	}
+	if len(s.staticEndpoints) > 0 {
+		klog.Infof("using the static endpoints %s, the resolver won't be contacted", s.staticEndpoints)
+	}
+	if s.gatewayIPOverride != "" {
+		klog.Infof("connecting to all the gateways via %s, GATEWAY_IP_OVERRIDE is set", s.gatewayIPOverride)
+	}
+
+	if *validateOnly {
+		if err := s.validate(token, resolverUrls, config, *validateHandshake); err != nil {
+			klog.Exitln("validation failed:", err)
+		}
+		klog.Infoln("validation passed")
+		klog.Flush()
+		return
+	}
+
+	if *diagnoseOnly {
+		passed := s.diagnose(os.Stdout, token, resolverUrls, config)
+		klog.Flush()
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.LocalProxyCheck != "" {
+		passed := s.checkLocalProxy(os.Stdout, token, resolverUrls, config, cfg.LocalProxyCheck)
+		klog.Flush()
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the one-shot modes above open no ports, so that they can run alongside an agent
+	var health *healthChecker
+	if cfg.HealthCheckURL != "" {
+		health = newHealthChecker(cfg.HealthCheckURL, s.timeout)
+		go health.run(time.Duration(cfg.HealthCheckInterval))
+	}
+	if cfg.ListenAddress != "" {
+		go listenAndServe(cfg.ListenAddress, cfg, agent, health)
+	}
+	if cfg.PprofAddress != "" {
+		go listenAndServePprof(cfg.PprofAddress)
+	}
+
+	if s.allDownTimeout > 0 {
+		go agent.connected.watch()
+	}
+
+	dumps := make(chan os.Signal, 1)
+	notifyDumps(dumps)
+	go handleDumps(dumps, agent, cfg.DumpGoroutines)
+
+	signal.Notify(agent.reload, syscall.SIGHUP)
+	notifyRefresh(agent.refresh)
+	agent.Start()
+	// a drain is requested via the /drain endpoint
+	<-agent.stop.C()
+	agent.Stop()
+	klog.Infoln("exiting")
+	klog.Flush()
+}
+
+// syncTunnels starts tunnels to the new endpoints and closes the ones to the endpoints the resolver no longer returns.
+func (a *Agent) syncTunnels(tunnels map[string]*Tunnel, endpoints []string, tlsServerName, token string, config []byte) {
+	fresh := map[string]bool{}
+	var added, removed, failed []string
+	for _, e := range endpoints {
+		fresh[e] = true
+		if _, ok := tunnels[e]; !ok {
+			addr, serverName, hints := parseEndpoint(e, tlsServerName)
+			// a bad endpoint is skipped and retried on the next cycle without blocking the others
+			if err := checkEndpoint(addr); err != nil {
+				failed = append(failed, fmt.Sprintf("%s (%s)", e, err))
+				continue
+			}
+			added = append(added, e)
+			klog.Infof("starting a tunnel to %s (%s)", addr, serverName)
+			tunnels[e] = a.newTunnel(addr, serverName, token, config, hints)
+		}
+	}
+	var stale []string
+	for e := range tunnels {
+		if !fresh[e] {
+			stale = append(stale, e)
+		}
+	}
+	// the most recently healthy tunnels to the stale endpoints are kept to have at least minTunnels
+	healthyAt := map[string]time.Time{}
+	for _, e := range stale {
+		healthyAt[e] = tunnels[e].lastHealthy()
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return healthyAt[stale[i]].After(healthyAt[stale[j]])
+	})
+	keep := a.settings.minTunnels - (len(tunnels) - len(stale))
+	for i, e := range stale {
+		if i < keep {
+			klog.Infof("keeping the tunnel with %s no longer returned by the resolver to have MIN_TUNNELS=%d", e, a.settings.minTunnels)
+			continue
+		}
+		removed = append(removed, e)
+		klog.Infof("closing tunnel with %s", e)
+		tunnels[e].Close()
+		delete(tunnels, e)
+	}
+	sort.Strings(removed)
+	switch {
+	case len(failed) > 0:
+		klog.Warningf("endpoints changed: added %s, removed %s, failed %s", added, removed, failed)
+	case len(added) > 0 || len(removed) > 0:
+		klog.Infof("endpoints changed: added %s, removed %s", added, removed)
+	}
+}
+
+var dscpWarning sync.Once
+
+// dscpControl marks the gateway connections with the configured DSCP value.
+// Failing to do so isn't fatal: the traffic is just sent unmarked.
+func (s *settings) dscpControl(network, address string, c syscall.RawConn) error {
+	if s.dscp < 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = setDSCP(fd, network, s.dscp) }); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		dscpWarning.Do(func() {
+			klog.Warningf("failed to set DSCP %d on the gateway connections: %s", s.dscp, err)
+		})
+	}
+	return nil
+}
+
+// checkEndpoint rejects the gateway addresses a tunnel can never be established to.
+func checkEndpoint(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// readConfig reads the config from a comma-separated list of files and directories.
+// The files, including those in the directories sorted by name, are concatenated with newline separation.
+func readConfig(path string) ([]byte, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var fragments []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, os.ExpandEnv(string(data)))
+	}
+	config := []byte(strings.Join(fragments, "\n"))
+	if len(bytes.TrimSpace(config)) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return config, nil
+}
+
+// configFiles expands the directories of the config path into the regular files they contain,
+// skipping hidden entries such as the ..data links of mounted ConfigMaps.
+func configFiles(path string) ([]string, error) {
+	var files []string
+	for _, p := range strings.Split(path, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			f := filepath.Join(p, e.Name())
+			if info, err := os.Stat(f); err != nil || info.IsDir() {
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files found in %s", path)
+	}
+	return files, nil
+}
 
-	loop(token, resolverUrl, config)
+// reloadConfig re-reads the config, keeping the last good one if the file is missing or empty,
+// so that a botched atomic replace doesn't result in sending an empty config to the gateways.
+func reloadConfig(path string, current []byte) []byte {
+	config, err := readConfig(path)
+	if err != nil {
+		klog.Errorf("failed to reload config, keeping the previous one: %s", err)
+		return current
+	}
+	return config
 }
 
-func loop(token, resolverUrl string, config []byte) {
-	u, err := url.Parse(resolverUrl)
+func (s *settings) validate(token string, resolverUrls []string, config []byte, handshake bool) error {
+	endpoints, serverName, err := newResolver(s, resolverUrls, token).Resolve()
 	if err != nil {
-		klog.Exitf("invalid resolver URL %s: %s", resolverUrl, err)
+		return fmt.Errorf("failed to get gateway endpoints: %s", err)
 	}
-	tlsServerName := u.Hostname()
+	if len(endpoints) == 0 {
+		return fmt.Errorf("the resolver returned no gateway endpoints")
+	}
+	klog.Infof("gateway endpoints: %s", endpoints)
+	if !handshake {
+		return nil
+	}
+	addr, serverName, hints := parseEndpoint(endpoints[0], serverName)
+	gwConn, err := s.connectWithHints(addr, serverName, token, config, hints)
+	if err != nil {
+		return err
+	}
+	_ = gwConn.Close()
+	return nil
+}
 
+func (a *Agent) loop() {
+	token, configPath, config := a.cfg.Token, a.cfg.ConfigPath, a.config
 	tunnels := map[string]*Tunnel{}
 
-	b := backoff.Backoff{Factor: backoffFactor, Min: backoffMin, Max: backoffMax}
+	resolver := newResolver(a.settings, a.cfg.ResolverUrls, token)
 	for {
-		klog.Infof("updating gateways endpoints from %s", resolverUrl)
-		endpoints, err := getEndpoints(resolverUrl, token)
+		endpoints, tlsServerName, err := resolver.Resolve()
 		if err != nil {
-			d := b.Duration()
+			d := resolver.RetryIn()
 			klog.Errorf("failed to get gateway endpoints: %s, retry in %.0fs", err, d.Seconds())
-			time.Sleep(d)
-			continue
+			select {
+			case <-time.After(d):
+				continue
+			case <-a.refresh:
+				klog.Infoln("refreshing the gateway endpoints on request")
+				continue
+			case <-a.stop.C():
+				drainTunnels(tunnels, a.settings.drainTimeout)
+				return
+			}
 		}
-		b.Reset()
 		klog.Infof("desired endpoints: %s", endpoints)
-		fresh := map[string]bool{}
-		for _, e := range endpoints {
-			fresh[e] = true
-			if _, ok := tunnels[e]; !ok {
-				klog.Infof("starting a tunnel to %s", e)
-				tunnels[e] = NewTunnel(e, tlsServerName, token, config)
+		if len(endpoints) == 0 {
+			if a.settings.minTunnels > 0 {
+				klog.Warningf("resolver returned no endpoints; keeping up to %d tunnels", a.settings.minTunnels)
+			} else {
+				klog.Warningln("resolver returned no endpoints; closing all tunnels")
 			}
 		}
-		for e, t := range tunnels {
-			if !fresh[e] {
-				klog.Infof("closing tunnel with %s", e)
-				t.Close()
-				delete(tunnels, e)
+		a.syncTunnels(tunnels, endpoints, tlsServerName, token, config)
+		a.connected.setNoEndpoints(len(tunnels) == 0 && len(endpoints) == 0)
+		select {
+		case <-time.After(a.settings.endpointsRefreshInterval):
+		case <-a.refresh:
+			klog.Infoln("refreshing the gateway endpoints on request")
+		case <-a.reload:
+			klog.Infof("reloading config from %s", configPath)
+			if c := reloadConfig(configPath, config); !bytes.Equal(c, config) {
+				config = c
+				for e, t := range tunnels {
+					klog.Infof("closing tunnel with %s to apply the new config", e)
+					t.Close()
+					delete(tunnels, e)
+				}
 			}
+		case <-a.stop.C():
+			drainTunnels(tunnels, a.settings.drainTimeout)
+			return
 		}
-		time.Sleep(endpointsRefreshInterval)
 	}
 }
 
-func getEndpoints(resolverUrl, token string) ([]string, error) {
-	req, _ := http.NewRequest("GET", resolverUrl, nil)
-	req.Header.Set("X-Token", token)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+// drainTunnels waits for the active streams of all the tunnels to complete, but no longer than the timeout, and closes the tunnels.
+func drainTunnels(tunnels map[string]*Tunnel, timeout time.Duration) {
+	klog.Infof("draining %d tunnels", len(tunnels))
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, t := range tunnels {
+			wg.Add(1)
+			go func(t *Tunnel) {
+				defer wg.Done()
+				t.Drain()
+			}(t)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		klog.Infoln("all the tunnels have been drained")
+	case <-time.After(timeout):
+		klog.Warningf("the tunnels haven't been drained within %s", timeout)
 	}
-	defer resp.Body.Close()
-	payload, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	for e, t := range tunnels {
+		t.Close()
+		delete(tunnels, e)
+	}
+}
+
+// parseEndpoint splits an endpoint in the form of ip:port@servername#key=value&key=value.
+// If the server name is omitted, the default one derived from the resolver URL is used.
+// The optional fragment holds the routing hints passed to the gateway in the handshake, the parts not in the key=value form are ignored.
+func parseEndpoint(endpoint, defaultServerName string) (string, string, map[string]string) {
+	endpoint, fragment, _ := strings.Cut(endpoint, "#")
+	var hints map[string]string
+	for _, h := range strings.Split(fragment, "&") {
+		key, value, ok := strings.Cut(h, "=")
+		if !ok || key == "" {
+			continue
+		}
+		if hints == nil {
+			hints = map[string]string{}
+		}
+		hints[key] = value
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%s: %s", resp.Status, string(payload))
+	addr, serverName, ok := strings.Cut(endpoint, "@")
+	if !ok || serverName == "" {
+		return addr, defaultServerName, hints
 	}
-	return strings.Split(strings.TrimSpace(string(payload)), ";"), nil
+	return addr, serverName, hints
 }
 
 type RequestHeader struct {
@@ -177,31 +973,321 @@ type ResponseHeader struct {
 	MessageSize uint16
 }
 
-func connect(gwAddr, serverName, token string, config []byte) (net.Conn, error) {
+// The statuses of the handshake response. Any status other than StatusOK means the gateway has rejected the agent,
+// and the message of the response explains why.
+const (
+	StatusOK            uint16 = 200
+	StatusBadRequest    uint16 = 400
+	StatusAuthFailed    uint16 = 401
+	StatusForbidden     uint16 = 403
+	StatusQuotaExceeded uint16 = 429
+	StatusInternalError uint16 = 500
+	StatusUnavailable   uint16 = 503
+)
+
+// statusText describes a handshake response status, including the ones this version of the agent doesn't know.
+func statusText(status uint16) string {
+	switch status {
+	case StatusOK:
+		return "ok"
+	case StatusBadRequest:
+		return "the handshake is malformed"
+	case StatusAuthFailed:
+		return "the project token is invalid"
+	case StatusForbidden:
+		return "the project isn't allowed to connect"
+	case StatusQuotaExceeded:
+		return "the project has exceeded its quota"
+	case StatusInternalError:
+		return "the gateway has failed"
+	case StatusUnavailable:
+		return "the gateway is unavailable"
+	}
+	return "unknown status"
+}
+
+// parseCapabilities parses the message of a successful handshake response, which lists the features supported by the gateway,
+// e.g. "compression: deflate; labels". Old gateways send no message, so none of the features is used with them.
+func parseCapabilities(message string) map[string]string {
+	res := map[string]string{}
+	for _, c := range strings.Split(message, ";") {
+		name, value, _ := strings.Cut(c, ":")
+		if name = strings.TrimSpace(name); name != "" {
+			res[name] = strings.TrimSpace(value)
+		}
+	}
+	return res
+}
+
+// writeLabels sends the agent labels to a gateway that supports them, right after the handshake response:
+// the size of the JSON-encoded labels followed by the labels themselves.
+func writeLabels(w io.Writer, labels map[string]string) error {
+	var data []byte
+	if len(labels) > 0 {
+		var err error
+		if data, err = json.Marshal(labels); err != nil {
+			return err
+		}
+	}
+	if len(data) > maxAgentLabelsSize {
+		return fmt.Errorf("the labels exceed %d bytes", maxAgentLabelsSize)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+type HandshakeError struct {
+	Gateway string
+	Status  uint16
+	Message string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("got %d (%s) from %s: %s", e.Status, statusText(e.Status), e.Gateway, e.Message)
+}
+
+func (e *HandshakeError) AuthFailed() bool {
+	return e.Status == StatusAuthFailed || e.Status == StatusForbidden
+}
+
+// authFailureTracker counts consecutive handshakes rejected by the gateways across all tunnels
+// to tell a revoked token from occasional failures.
+type authFailureTracker struct {
+	threshold int
+	exit      bool
+
+	lock        sync.Mutex
+	consecutive int
+}
+
+func newAuthFailureTracker(threshold int, exit bool) *authFailureTracker {
+	return &authFailureTracker{threshold: threshold, exit: exit}
+}
+
+func (a *authFailureTracker) rejected() {
+	authFailuresTotal.Inc()
+	a.lock.Lock()
+	a.consecutive++
+	tripped := a.consecutive == a.threshold
+	a.lock.Unlock()
+	if !tripped {
+		return
+	}
+	klog.Errorf("THE PROJECT TOKEN APPEARS TO BE INVALID OR REVOKED: %d consecutive handshakes have been rejected by the gateways", a.threshold)
+	if a.exit {
+		klog.Exitln("exiting due to EXIT_ON_AUTH_FAILURE")
+	}
+}
+
+func (a *authFailureTracker) reset() {
+	a.lock.Lock()
+	a.consecutive = 0
+	a.lock.Unlock()
+}
+
+// tunnelTracker counts the tunnels connected to the gateways to detect that all of them have been down for longer than allDownTimeout.
+type tunnelTracker struct {
+	allDownTimeout time.Duration
+	exitOnAllDown  bool
+
+	lock      sync.Mutex
+	connected int
+	downSince time.Time
+	alerted   bool
+	// noEndpoints is set while the resolver returns no endpoints, e.g. when the project is paused.
+	noEndpoints bool
+}
+
+func newTunnelTracker(allDownTimeout time.Duration, exitOnAllDown bool) *tunnelTracker {
+	return &tunnelTracker{allDownTimeout: allDownTimeout, exitOnAllDown: exitOnAllDown, downSince: time.Now()}
+}
+
+func (t *tunnelTracker) up() {
+	t.lock.Lock()
+	t.connected++
+	t.alerted = false
+	t.lock.Unlock()
+}
+
+func (t *tunnelTracker) down() {
+	t.lock.Lock()
+	t.connected--
+	if t.connected == 0 {
+		t.downSince = time.Now()
+	}
+	t.lock.Unlock()
+}
+
+func (t *tunnelTracker) setNoEndpoints(v bool) {
+	t.lock.Lock()
+	t.noEndpoints = v
+	t.lock.Unlock()
+}
+
+func (t *tunnelTracker) hasEndpoints() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return !t.noEndpoints
+}
+
+// ready reports false once no tunnel has been connected for longer than allDownTimeout.
+func (t *tunnelTracker) ready() bool {
+	if t.allDownTimeout <= 0 {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.connected > 0 || time.Since(t.downSince) < t.allDownTimeout
+}
+
+// check logs once per outage that all the tunnels are down and exits if EXIT_ON_ALL_DOWN is set.
+func (t *tunnelTracker) check() {
+	if t.ready() {
+		return
+	}
+	t.lock.Lock()
+	alerted := t.alerted
+	t.alerted = true
+	t.lock.Unlock()
+	if alerted {
+		return
+	}
+	klog.Errorf("ALL THE TUNNELS HAVE BEEN DOWN FOR MORE THAN %s", t.allDownTimeout)
+	if t.exitOnAllDown {
+		klog.Exitln("exiting due to EXIT_ON_ALL_DOWN")
+	}
+}
+
+func (t *tunnelTracker) watch() {
+	for range time.Tick(time.Second) {
+		t.check()
+	}
+}
+
+// configWriteError means that the config hasn't been fully sent to the gateway.
+type configWriteError struct {
+	gateway        string
+	written, total int
+	err            error
+}
+
+func (e *configWriteError) Error() string {
+	return fmt.Sprintf("failed to send config to %s: %d of %d bytes written: %s", e.gateway, e.written, e.total, e.err)
+}
+
+// connect establishes a connection to the gateway and performs the handshake.
+// A TLS connection is unusable after a failed write, so the handshake is retried from scratch if the config hasn't been fully sent.
+func (s *settings) connect(gwAddr, serverName, token string, config []byte) (net.Conn, error) {
+	return s.connectWithHints(gwAddr, serverName, token, config, nil)
+}
+
+// connectWithHints establishes a connection to the gateway passing it the routing hints of the endpoint.
+func (s *settings) connectWithHints(gwAddr, serverName, token string, config []byte, hints map[string]string) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		gwConn, err := s.handshake(gwAddr, serverName, token, config, hints)
+		var we *configWriteError
+		if errors.As(err, &we) && attempt < s.configWriteAttempts {
+			klog.Warningf("%s, retrying the handshake", err)
+			continue
+		}
+		return gwConn, err
+	}
+}
+
+// gatewayDialTarget returns the address to dial and the TLS server name to verify for the gateway.
+// With GATEWAY_IP_OVERRIDE set, the connection goes to that IP instead, while the certificate is still verified
+// against the server name, or the host of the gateway address if there is none, like curl --resolve does.
+func (s *settings) gatewayDialTarget(gwAddr, serverName string) (string, string) {
+	if s.gatewayIPOverride == "" {
+		return gwAddr, serverName
+	}
+	host, port, err := net.SplitHostPort(gwAddr)
+	if err != nil {
+		return gwAddr, serverName
+	}
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	return net.JoinHostPort(s.gatewayIPOverride, port), serverName
+}
+
+// dialGateway establishes a TLS connection to the gateway, or a plaintext one if TLS_DISABLED is set.
+func (s *settings) dialGateway(gwAddr, serverName string) (net.Conn, error) {
+	dialAddr, serverName := s.gatewayDialTarget(gwAddr, serverName)
+	if dialAddr != gwAddr {
+		klog.V(2).Infof("dialing %s instead of %s as GATEWAY_IP_OVERRIDE is set", dialAddr, gwAddr)
+	}
+	dialer := &net.Dialer{
+		Deadline:  time.Now().Add(s.dialTimeout),
+		LocalAddr: s.sourceAddress,
+		KeepAlive: s.tcpKeepAlive,
+		Control:   s.dscpControl,
+		Resolver:  s.dnsResolver,
+	}
+	if s.tlsDisabled {
+		gwConn, err := dialer.Dial(s.gatewayDialNetwork, dialAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to establish a connection to %s: %s", gwAddr, err)
+		}
+		s.setNoDelay(gwConn)
+		klog.Infof("connected to gateway %s (plaintext)", gwAddr)
+		return gwConn, nil
+	}
+	tlsCfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: s.tlsSkipVerify, ClientSessionCache: s.tlsSessionCache}
+	gwConn, err := tls.DialWithDialer(dialer, s.gatewayDialNetwork, dialAddr, tlsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish a connection to %s: %s", gwAddr, err)
+	}
+	s.setNoDelay(gwConn)
+	state := gwConn.ConnectionState()
+	klog.Infof("connected to gateway %s (%s, %s)", gwAddr, tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if state.DidResume {
+		klog.V(2).Infof("resumed the TLS session with gateway %s", gwAddr)
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		klog.V(2).Infof("gateway %s certificate: subject=%q, issuer=%q, expires=%s", gwAddr, cert.Subject, cert.Issuer, cert.NotAfter)
+		if expiresIn := time.Until(cert.NotAfter); expiresIn < s.certExpiryWarn {
+			klog.Warningf("the certificate of gateway %s expires in %s (%s)", gwAddr, expiresIn.Truncate(time.Second), cert.NotAfter)
+			certExpiryWarnings.WithLabelValues(gwAddr, serverName).Inc()
+		}
+	}
+	return gwConn, nil
+}
+
+func (s *settings) handshake(gwAddr, serverName, token string, config []byte, hints map[string]string) (net.Conn, error) {
 	requestHeader := RequestHeader{}
 	copy(requestHeader.Token[:], token)
-	copy(requestHeader.Version[:], version)
+	advertisedVersion, compressionAdvertised := s.handshakeVersion()
+	copy(requestHeader.Version[:], advertisedVersion)
 	requestHeader.ConfigSize = uint32(len(config))
 
 	klog.Infof("connecting to %s (%s)", gwAddr, serverName)
-	deadline := time.Now().Add(timeout)
-	dialer := &net.Dialer{Deadline: deadline}
-	tlsCfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: tlsSkipVerify}
-	gwConn, err := tls.DialWithDialer(dialer, "tcp", gwAddr, tlsCfg)
+	start := time.Now()
+	gwConn, err := s.dialGateway(gwAddr, serverName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to establish a connection to %s: %s", gwAddr, err)
+		return nil, err
 	}
-	klog.Infof("connected to gateway %s", gwAddr)
 
-	_ = gwConn.SetDeadline(deadline)
+	_ = gwConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
 	if err = binary.Write(gwConn, binary.LittleEndian, requestHeader); err != nil {
 		_ = gwConn.Close()
 		return nil, fmt.Errorf("failed to send config to %s: %s", gwAddr, err)
 	}
-	if _, err = gwConn.Write(config); err != nil {
+	_ = gwConn.SetWriteDeadline(time.Now().Add(s.configWriteTimeout))
+	n, err := gwConn.Write(config)
+	if err == nil && n < len(config) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
 		_ = gwConn.Close()
-		return nil, fmt.Errorf("failed to send config to %s: %s", gwAddr, err)
+		return nil, &configWriteError{gateway: gwAddr, written: n, total: len(config), err: err}
 	}
+	// the handshake deadline set before the config write may have already passed if the write took long
+	_ = gwConn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
 	var responseHeader ResponseHeader
 	if err := binary.Read(gwConn, binary.LittleEndian, &responseHeader); err != nil {
 		_ = gwConn.Close()
@@ -210,7 +1296,7 @@ func connect(gwAddr, serverName, token string, config []byte) (net.Conn, error)
 	var responseMessage string
 	if responseHeader.MessageSize > 0 {
 		buf := make([]byte, responseHeader.MessageSize)
-		if _, err := gwConn.Read(buf); err != nil {
+		if _, err := io.ReadFull(gwConn, buf); err != nil {
 			_ = gwConn.Close()
 			return nil, fmt.Errorf("failed to read the response from %s: %s", gwAddr, err)
 		}
@@ -218,73 +1304,94 @@ func connect(gwAddr, serverName, token string, config []byte) (net.Conn, error)
 	}
 	_ = gwConn.SetDeadline(time.Time{})
 
-	if responseHeader.Status != 200 {
+	if responseHeader.Status != StatusOK {
 		_ = gwConn.Close()
-		return nil, fmt.Errorf("got %d from %s: %s", responseHeader.Status, gwAddr, responseMessage)
+		return nil, &HandshakeError{Gateway: gwAddr, Status: responseHeader.Status, Message: responseMessage}
 	}
+	connectDuration.WithLabelValues(gwAddr, serverName).Observe(time.Since(start).Seconds())
 	klog.Infof("ready to proxy requests from %s", gwAddr)
+	capabilities := parseCapabilities(responseMessage)
+	if _, ok := capabilities["labels"]; ok {
+		_ = gwConn.SetWriteDeadline(time.Now().Add(s.handshakeTimeout))
+		// the routing hints of the endpoint are sent along with the labels, taking precedence over the labels of the same name
+		labels := s.agentLabels
+		if len(hints) > 0 {
+			labels = map[string]string{}
+			for k, v := range s.agentLabels {
+				labels[k] = v
+			}
+			for k, v := range hints {
+				labels[k] = v
+			}
+		}
+		if err := writeLabels(gwConn, labels); err != nil {
+			_ = gwConn.Close()
+			return nil, fmt.Errorf("failed to send labels to %s: %s", gwAddr, err)
+		}
+		_ = gwConn.SetWriteDeadline(time.Time{})
+	}
+	if compressionAdvertised {
+		if capabilities["compression"] == "deflate" {
+			klog.Infof("the tunnel to %s is compressed", gwAddr)
+			return newCompressedConn(gwConn), nil
+		}
+		klog.Infof("gateway %s doesn't support compression, the tunnel is not compressed", gwAddr)
+	}
 	return gwConn, nil
 }
 
-func proxy(ctx context.Context, gwConn net.Conn) error {
-	cfg := yamux.DefaultConfig()
-	cfg.KeepAliveInterval = time.Second
-	cfg.LogOutput = io.Discard
-	session, err := yamux.Server(gwConn, cfg)
-	if err != nil {
-		return fmt.Errorf("failed to start a TCP multiplexing server: %s", err)
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
 	}
-	defer session.Close()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			gwStream, err := session.Accept()
-			if err != nil {
-				return fmt.Errorf("failed to accept a stream: %s", err)
-			}
-			go func(c net.Conn) {
-				defer c.Close()
-				deadline := time.Now().Add(streamTimeout)
-				if err := c.SetDeadline(deadline); err != nil {
-					klog.Errorf("failed to set a deadline for the stream: %s", err)
-					return
-				}
-				var dstLen uint16
-				if err := binary.Read(c, binary.LittleEndian, &dstLen); err != nil {
-					klog.Errorf("failed to read the destination size: %s", err)
-					return
-				}
-				dest := make([]byte, int(dstLen))
-				if _, err := io.ReadFull(c, dest); err != nil {
-					klog.Errorf("failed to read the destination address: %s", err)
-					return
-				}
-				destAddress := string(dest)
-				destConn, err := net.DialTimeout("tcp", destAddress, timeout)
-				if err != nil {
-					klog.Errorf("failed to establish a connection to %s: %s", destAddress, err)
-					return
-				}
-				defer destConn.Close()
-				if err = destConn.SetDeadline(deadline); err != nil {
-					klog.Errorf("failed to set a deadline for the dest connection: %s", err)
-					return
-				}
-				go func() {
-					io.Copy(c, destConn)
-				}()
-				io.Copy(destConn, c)
-			}(gwStream)
-		}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// setLogLevel sets the klog verbosity (the -v flag): certificate details are logged at 2, per-stream events and the resolver responses at 4.
+func setLogLevel(level int) error {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	return flags.Set("v", strconv.Itoa(level))
+}
+
+// setLogFile makes klog write to the file as well as to stderr.
+// klog writes each line to the outputs of its severity and all the lower ones, so the file is set for INFO only.
+func setLogFile(w io.Writer) error {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	if err := flags.Set("logtostderr", "false"); err != nil {
+		return err
 	}
+	if err := flags.Set("alsologtostderr", "true"); err != nil {
+		return err
+	}
+	klog.SetOutput(io.Discard)
+	klog.SetOutputBySeverity("INFO", w)
+	return nil
 }
 
-func mustEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		klog.Exitln(key, "environment variable is required")
+// resolverUrlsFromEnv returns the resolver URLs from RESOLVER_URL, falling back to the built-in default
+// that can be overridden at build time with -ldflags "-X github.com/coroot/coroot-connect.defaultResolverUrl=...".
+func resolverUrlsFromEnv() []string {
+	if urls := listEnv("RESOLVER_URL"); len(urls) > 0 {
+		return urls
+	}
+	return []string{defaultResolverUrl}
+}
+
+func listEnv(key string) []string {
+	var res []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
 	}
-	return value
+	return res
 }
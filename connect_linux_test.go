@@ -0,0 +1,184 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPKeepAlive(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	s.tcpKeepAlive = 7 * time.Second
+
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		readHeaderAndConfig(t, conn, token, []byte("config_data"))
+		writeResponse(t, conn, 200, "")
+	})
+	defer stop()
+
+	gwConn, err := s.connect(addr, "", token, []byte("config_data"))
+	require.NoError(t, err)
+	defer gwConn.Close()
+
+	raw, err := gwConn.(*tls.Conn).NetConn().(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var enabled, idle int
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		require.NoError(t, err)
+		idle, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		require.NoError(t, err)
+	}))
+	assert.Equal(t, 1, enabled)
+	assert.Equal(t, 7, idle)
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+
+	noDelay := func(conn net.Conn) int {
+		if c, ok := conn.(*tls.Conn); ok {
+			conn = c.NetConn()
+		}
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		require.NoError(t, err)
+		var v int
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			require.NoError(t, err)
+		}))
+		return v
+	}
+
+	addr, stop := gateway(t, func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			readHeaderAndConfig(t, conn, token, []byte("config_data"))
+			writeResponse(t, conn, 200, "")
+		}
+	})
+	defer stop()
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer destination.Close()
+
+	for _, enabled := range []bool{true, false} {
+		s.tcpNoDelay = enabled
+		expected := 0
+		if enabled {
+			expected = 1
+		}
+
+		gwConn, err := s.connect(addr, "", token, []byte("config_data"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, noDelay(gwConn))
+		_ = gwConn.Close()
+
+		destConn, err := newProxy(s).dial(context.Background(), "tcp", destination.Addr().String())
+		require.NoError(t, err)
+		assert.Equal(t, expected, noDelay(destConn))
+		_ = destConn.Close()
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	s.dscp = 46
+
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		readHeaderAndConfig(t, conn, token, []byte("config_data"))
+		writeResponse(t, conn, 200, "")
+	})
+	defer stop()
+
+	gwConn, err := s.connect(addr, "", token, []byte("config_data"))
+	require.NoError(t, err)
+	defer gwConn.Close()
+
+	raw, err := gwConn.(*tls.Conn).NetConn().(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var tos int
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		require.NoError(t, err)
+	}))
+	assert.Equal(t, 46<<2, tos)
+}
+
+func TestStateDump(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	logs := captureLogs(t)
+
+	addr, stop := gateway(t, func(listener net.Listener) {
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		readHeaderAndConfig(t, conn, token, []byte("config_data"))
+		writeResponse(t, conn, 200, "")
+	})
+	defer stop()
+	a := testAgent()
+	tunnel := a.newTunnel(addr, "example.com", token, []byte("config_data"), nil)
+	defer tunnel.Close()
+	assert.Eventually(t, func() bool {
+		return tunnel.status().ConnectedSessions == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dumps := make(chan os.Signal, 1)
+	go handleDumps(dumps, a, true)
+	defer close(dumps)
+	notifyDumps(dumps)
+	defer signal.Stop(dumps)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "goroutines:")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), "state dump: ")
+	assert.Contains(t, logs.String(), "tunnel to "+addr+" (example.com): 1/1 sessions connected, 0 active streams")
+	assert.Contains(t, logs.String(), "handleDumps")
+}
+
+func TestEndpointsRefreshSignal(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	logs := captureLogs(t)
+	var requests int32
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer resolver.Close()
+
+	cfg := testConfig()
+	cfg.Token = token
+	cfg.ResolverUrls = []string{resolver.URL}
+	a := newAgent(cfg, []byte("config_data"))
+	notifyRefresh(a.refresh)
+	defer signal.Stop(a.refresh)
+	a.Start()
+	defer a.Stop()
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&requests) == 1 }, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&requests) == 2 }, 3*time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), "refreshing the gateway endpoints on request")
+}
@@ -0,0 +1,225 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diagnosticStep is a single check of the diagnose mode.
+type diagnosticStep struct {
+	name   string
+	target string
+	result string
+	err    error
+}
+
+// diagnose checks every step required to establish the tunnels, from resolving the resolver's name to the token handshake,
+// and prints a table telling which of them failed and why. It returns false if any step failed.
+func (s *settings) diagnose(w io.Writer, token string, resolverUrls []string, config []byte) bool {
+	var steps []diagnosticStep
+	check := func(name, target string, f func() (string, error)) bool {
+		result, err := f()
+		steps = append(steps, diagnosticStep{name: name, target: target, result: result, err: err})
+		return err == nil
+	}
+
+	for _, u := range resolverUrls {
+		resolverUrl, err := url.Parse(u)
+		if err != nil {
+			check("dns", u, func() (string, error) { return "", err })
+			continue
+		}
+		check("dns", resolverUrl.Hostname(), func() (string, error) { return s.lookup(resolverUrl.Hostname()) })
+	}
+
+	var endpoints []string
+	var tlsServerName string
+	check("resolver", strings.Join(resolverUrls, ","), func() (string, error) {
+		var err error
+		endpoints, tlsServerName, err = newResolver(s, resolverUrls, token).Resolve()
+		if err != nil {
+			return "", err
+		}
+		if len(endpoints) == 0 {
+			return "", fmt.Errorf("no gateway endpoints")
+		}
+		return fmt.Sprintf("%d endpoints", len(endpoints)), nil
+	})
+
+	for _, e := range endpoints {
+		addr, serverName, hints := parseEndpoint(e, tlsServerName)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			check("endpoint", e, func() (string, error) { return "", err })
+			continue
+		}
+		// the host isn't resolved with GATEWAY_IP_OVERRIDE set
+		dialAddr, verifiedName := s.gatewayDialTarget(addr, serverName)
+		if dialAddr == addr && net.ParseIP(host) == nil && !check("dns", host, func() (string, error) { return s.lookup(host) }) {
+			continue
+		}
+		var conn net.Conn
+		if !check("tcp", dialAddr, func() (string, error) {
+			dialer := &net.Dialer{Timeout: s.dialTimeout, LocalAddr: s.sourceAddress, Resolver: s.dnsResolver}
+			conn, err = dialer.Dial(s.gatewayDialNetwork, dialAddr)
+			if err != nil {
+				return "", err
+			}
+			return conn.LocalAddr().String(), nil
+		}) {
+			continue
+		}
+		// there is no TLS layer to check with TLS_DISABLED
+		ok := s.tlsDisabled || check("tls", addr, func() (string, error) {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: verifiedName, InsecureSkipVerify: s.tlsSkipVerify})
+			_ = tlsConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				return "", err
+			}
+			return tlsVersionName(tlsConn.ConnectionState().Version), nil
+		})
+		_ = conn.Close()
+		if !ok {
+			continue
+		}
+		check("handshake", addr, func() (string, error) {
+			gwConn, err := s.connectWithHints(addr, serverName, token, config, hints)
+			if err != nil {
+				return "", err
+			}
+			_ = gwConn.Close()
+			return "", nil
+		})
+	}
+	return printSteps(w, steps)
+}
+
+// checkLocalProxy performs a handshake with one of the gateways, then sends an HTTP GET request to the destination URL
+// through a stream served by a local proxy the same way as the streams from the gateways, and prints the results.
+// It returns false if any step failed.
+// The gateway protocol has no streams opened by the agent, so the request doesn't traverse the gateway,
+// and the gateway leg of the data path isn't tested.
+func (s *settings) checkLocalProxy(w io.Writer, token string, resolverUrls []string, config []byte, destination string) bool {
+	var steps []diagnosticStep
+	check := func(name, target string, f func() (string, error)) bool {
+		result, err := f()
+		steps = append(steps, diagnosticStep{name: name, target: target, result: result, err: err})
+		return err == nil
+	}
+	var endpoints []string
+	var tlsServerName string
+	ok := check("resolver", strings.Join(resolverUrls, ","), func() (string, error) {
+		var err error
+		endpoints, tlsServerName, err = newResolver(s, resolverUrls, token).Resolve()
+		if err != nil {
+			return "", err
+		}
+		if len(endpoints) == 0 {
+			return "", fmt.Errorf("no gateway endpoints")
+		}
+		return fmt.Sprintf("%d endpoints", len(endpoints)), nil
+	})
+	if ok {
+		addr, serverName, hints := parseEndpoint(endpoints[0], tlsServerName)
+		ok = check("handshake", addr, func() (string, error) {
+			gwConn, err := s.connectWithHints(addr, serverName, token, config, hints)
+			if err != nil {
+				return "", err
+			}
+			_ = gwConn.Close()
+			return "", nil
+		})
+	}
+	if ok {
+		check("local proxy", destination, func() (string, error) {
+			return requestThroughProxy(newProxy(s), destination)
+		})
+	}
+	passed := printSteps(w, steps)
+	fmt.Fprintln(w, "note: the request went through a local proxy, not through the gateway, so the gateway leg of the data path was not tested")
+	return passed
+}
+
+// requestThroughProxy sends an HTTP GET request to the URL through a stream served by the proxy
+// and returns the status of the response followed by the beginning of its body.
+func requestThroughProxy(p *Proxy, destination string) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	client := &http.Client{
+		Timeout: p.settings.timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				gwSide, agentSide := net.Pipe()
+				go p.handleStream(agentSide)
+				if err := writeStreamHeader(gwSide, &StreamHeader{Destination: addr}); err != nil {
+					_ = gwSide.Close()
+					return nil, err
+				}
+				return gwSide, nil
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(destination)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 100))
+	if err != nil {
+		return "", err
+	}
+	result := resp.Status
+	if s := strings.TrimSpace(string(body)); s != "" {
+		result += ": " + s
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("%s", result)
+	}
+	return result, nil
+}
+
+// printSteps prints the results of the steps as a table and returns false if any of them failed.
+func printSteps(w io.Writer, steps []diagnosticStep) bool {
+	passed := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tTARGET\tRESULT")
+	for _, s := range steps {
+		result := "ok"
+		if s.err != nil {
+			passed = false
+			result = "FAIL: " + s.err.Error()
+		} else if s.result != "" {
+			result += " (" + s.result + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.name, s.target, result)
+	}
+	_ = tw.Flush()
+	return passed
+}
+
+func (s *settings) lookup(host string) (string, error) {
+	addrs, err := s.dnsResolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(addrs, ", "), nil
+}
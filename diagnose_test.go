@@ -0,0 +1,111 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	addr, stop := gateway(t, func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			h := RequestHeader{}
+			if err := binary.Read(conn, binary.LittleEndian, &h); err != nil {
+				_ = conn.Close() // the TLS check
+				continue
+			}
+			config := make([]byte, h.ConfigSize)
+			_, _ = conn.Read(config)
+			if string(h.Token[:]) != token {
+				writeResponse(t, conn, 401, "invalid token")
+			} else {
+				writeResponse(t, conn, 200, "")
+			}
+			_ = conn.Close()
+		}
+	})
+	defer stop()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s;%s", addr, closedAddr)
+	}))
+	defer resolver.Close()
+
+	out := &bytes.Buffer{}
+	assert.False(t, testSettings().diagnose(out, token, []string{resolver.URL}, []byte("config_data")))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 7)
+	assert.Regexp(t, `^STEP\s+TARGET\s+RESULT$`, lines[0])
+	assert.Regexp(t, `^dns\s+127\.0\.0\.1\s+ok`, lines[1])
+	assert.Regexp(t, `^resolver\s+http://127\.0\.0\.1:\d+\s+ok \(2 endpoints\)$`, lines[2])
+	assert.Regexp(t, `^tcp\s+`+addr+`\s+ok`, lines[3])
+	assert.Regexp(t, `^tls\s+`+addr+`\s+ok \(TLS 1\.3\)$`, lines[4])
+	assert.Regexp(t, `^handshake\s+`+addr+`\s+ok$`, lines[5])
+	assert.Regexp(t, `^tcp\s+`+closedAddr+`\s+FAIL: .*connection refused$`, lines[6])
+
+	out.Reset()
+	assert.False(t, testSettings().diagnose(out, "00000000-0000-0000-0000-000000000000", []string{resolver.URL}, []byte("config_data")))
+	assert.Regexp(t, `handshake\s+`+addr+`\s+FAIL: got 401 \(the project token is invalid\) from `+addr+`: invalid token`, out.String())
+
+	out.Reset()
+	resolver.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, addr)
+	})
+	assert.True(t, testSettings().diagnose(out, token, []string{resolver.URL}, []byte("config_data")))
+}
+
+func TestLocalProxyCheck(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	addr, stop := gateway(t, func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			readHeaderAndConfig(t, conn, token, []byte("config_data"))
+			writeResponse(t, conn, StatusOK, "")
+			_ = conn.Close()
+		}
+	})
+	defer stop()
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, addr)
+	}))
+	defer resolver.Close()
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/-/healthy" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "Prometheus Server is Healthy.")
+	}))
+	defer prometheus.Close()
+
+	out := &bytes.Buffer{}
+	assert.True(t, testSettings().checkLocalProxy(out, token, []string{resolver.URL}, []byte("config_data"), prometheus.URL+"/-/healthy"))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 5)
+	assert.Regexp(t, `^resolver\s+http://127\.0\.0\.1:\d+\s+ok \(1 endpoints\)$`, lines[1])
+	assert.Regexp(t, `^handshake\s+`+addr+`\s+ok$`, lines[2])
+	assert.Regexp(t, `^local proxy\s+`+prometheus.URL+`/-/healthy\s+ok \(200 OK: Prometheus Server is Healthy\.\)$`, lines[3])
+	assert.Contains(t, lines[4], "the gateway leg of the data path was not tested")
+
+	out.Reset()
+	assert.False(t, testSettings().checkLocalProxy(out, token, []string{resolver.URL}, []byte("config_data"), prometheus.URL+"/metrics"))
+	assert.Regexp(t, `local proxy\s+`+prometheus.URL+`/metrics\s+FAIL: 404 Not Found: 404 page not found`, out.String())
+}
@@ -0,0 +1,21 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// newDNSResolver returns a resolver querying the given DNS servers instead of the ones configured on the node.
+// Each query goes to the next server, so a retried query fails over to another one.
+func newDNSResolver(servers []string) *net.Resolver {
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package connect
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDNSServers(t *testing.T) {
+	queries := make(chan string, 10)
+	stub := dnsStub(t, map[string][4]byte{"prometheus.coroot.test.": {127, 0, 0, 1}}, queries)
+	defer stub.Close()
+	s := testSettings()
+	s.dnsResolver = newDNSResolver([]string{stub.LocalAddr().String()})
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer destination.Close()
+	_, port, err := net.SplitHostPort(destination.Listener.Addr().String())
+	require.NoError(t, err)
+
+	stream := serveStream(newProxy(s))
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus.coroot.test:" + port}))
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, "prometheus.coroot.test.", <-queries)
+
+	addrs, err := s.lookup("prometheus.coroot.test")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addrs)
+}
+
+// dnsStub answers the A queries for the given names over UDP and reports the queried names.
+func dnsStub(t *testing.T, records map[string][4]byte, queries chan<- string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			select {
+			case queries <- q.Name.String():
+			default:
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			ip, ok := records[q.Name.String()]
+			if ok && q.Type == dnsmessage.TypeA {
+				_ = b.StartAnswers()
+				_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				panic(fmt.Sprintf("failed to build a DNS response: %s", err))
+			}
+			_, _ = conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn
+}
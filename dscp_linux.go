@@ -0,0 +1,11 @@
+package connect
+
+import "syscall"
+
+// setDSCP sets the DSCP bits of the IP TOS (IPv4) or traffic class (IPv6) of the socket.
+func setDSCP(fd uintptr, network string, value int) error {
+	if network == "tcp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, value<<2)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, value<<2)
+}
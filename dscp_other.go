@@ -0,0 +1,12 @@
+//go:build !linux
+
+package connect
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func setDSCP(fd uintptr, network string, value int) error {
+	return fmt.Errorf("not supported on %s", runtime.GOOS)
+}
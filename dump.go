@@ -0,0 +1,29 @@
+package connect
+
+import (
+	"bytes"
+	"k8s.io/klog"
+	"os"
+	"runtime/pprof"
+)
+
+// handleDumps logs the state of the tunnels on each signal received, along with the stacks of all goroutines if requested.
+func handleDumps(signals <-chan os.Signal, a *Agent, goroutines bool) {
+	for range signals {
+		dumpState(a, goroutines)
+	}
+}
+
+func dumpState(a *Agent, goroutines bool) {
+	tunnels := a.tunnels.status()
+	klog.Infof("state dump: %d tunnels", len(tunnels))
+	for _, t := range tunnels {
+		klog.Infof("tunnel to %s (%s): %d/%d sessions connected, %d active streams, last error: %q",
+			t.Gateway, t.ServerName, t.ConnectedSessions, t.Sessions, t.ActiveStreams, t.LastError)
+	}
+	if goroutines {
+		buf := &bytes.Buffer{}
+		_ = pprof.Lookup("goroutine").WriteTo(buf, 2)
+		klog.Infof("goroutines:\n%s", buf)
+	}
+}
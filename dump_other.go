@@ -0,0 +1,14 @@
+//go:build !windows
+
+package connect
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumps relays SIGUSR1 to c to trigger a dump of the state.
+func notifyDumps(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,6 @@
+package connect
+
+import "os"
+
+// notifyDumps does nothing, as there is no SIGUSR1 on Windows.
+func notifyDumps(c chan<- os.Signal) {}
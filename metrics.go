@@ -0,0 +1,160 @@
+package connect
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	tunnelUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coroot_connect_tunnel_up",
+		Help: "Number of connected sessions of the tunnel to a gateway",
+	}, []string{"gateway", "server_name"})
+
+	sessionStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coroot_connect_session_streams",
+		Help: "Number of active streams of a session to a gateway",
+	}, []string{"gateway", "server_name", "session"})
+
+	sessionRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coroot_connect_session_rtt_seconds",
+		Help: "Round-trip time of a session to a gateway measured with a yamux ping",
+	}, []string{"gateway", "server_name", "session"})
+
+	reconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_reconnect_attempts_total",
+		Help: "Number of attempts to connect to a gateway",
+	}, []string{"gateway", "server_name"})
+
+	reconnectFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_reconnect_failures_total",
+		Help: "Number of failed attempts to connect to a gateway",
+	}, []string{"gateway", "server_name"})
+
+	reconnectBackoff = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coroot_connect_reconnect_backoff_seconds",
+		Help: "Current delay before reconnecting to a gateway, 0 once connected",
+	}, []string{"gateway", "server_name"})
+
+	certExpiryWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_gateway_certificate_expiry_warnings_total",
+		Help: "Number of connections to a gateway whose certificate expires within the warning window",
+	}, []string{"gateway", "server_name"})
+
+	connectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coroot_connect_gateway_connect_duration_seconds",
+		Help:    "Time from dialing a gateway to a successful handshake",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"gateway", "server_name"})
+
+	streamPanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "coroot_connect_stream_panics_total",
+		Help: "Number of panics recovered while proxying streams",
+	})
+
+	destinationDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_destination_dial_errors_total",
+		Help: "Number of failed connections to destinations by reason: dns, refused, timeout, ports_exhausted, or other",
+	}, []string{"reason"})
+
+	streamCopyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_stream_copy_errors_total",
+		Help: "Number of streams ended by an error by direction (up or down) and reason: reset, timeout, or other",
+	}, []string{"direction", "reason"})
+
+	destinationStreams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_destination_streams_total",
+		Help: "Number of streams proxied to a destination, the destinations beyond MAX_DESTINATION_LABELS are counted as other",
+	}, []string{"destination"})
+
+	destinationBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_destination_bytes_total",
+		Help: "Number of bytes proxied to (up) and from (down) a destination, the destinations beyond MAX_DESTINATION_LABELS are counted as other",
+	}, []string{"destination", "direction"})
+
+	streamsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "coroot_connect_streams_rejected_total",
+		Help: "Number of streams rejected as their session has reached MAX_CONCURRENT_STREAMS",
+	})
+
+	destinationRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_destination_rate_limited_total",
+		Help: "Number of streams to a destination rejected due to DEST_MAX_RPS, the destinations beyond MAX_DESTINATION_LABELS are counted as other",
+	}, []string{"destination"})
+
+	streamTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "coroot_connect_stream_timeouts_total",
+		Help: "Number of streams closed after no data was relayed within STREAM_TIMEOUT, the destinations beyond MAX_DESTINATION_LABELS are counted as other",
+	}, []string{"destination"})
+
+	authFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "coroot_connect_auth_failures_total",
+		Help: "Number of handshakes rejected by the gateways due to an invalid token",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tunnelUp, sessionStreams, sessionRTT, reconnectAttempts, reconnectFailures, reconnectBackoff, certExpiryWarnings, connectDuration, streamPanicsTotal, destinationDialErrors, streamCopyErrors, destinationStreams, destinationBytes, destinationRateLimited, streamTimeouts, streamsRejected, authFailuresTotal)
+}
+
+// unregisterRuntimeMetrics removes the Go runtime (go_*) and process (process_*) collectors the default registry comes with.
+func unregisterRuntimeMetrics(registerer prometheus.Registerer) {
+	registerer.Unregister(collectors.NewGoCollector())
+	registerer.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// deleteTunnelMetrics removes the series of a closed tunnel to keep the cardinality bounded.
+func deleteTunnelMetrics(gateway string) {
+	labels := prometheus.Labels{"gateway": gateway}
+	tunnelUp.DeletePartialMatch(labels)
+	sessionStreams.DeletePartialMatch(labels)
+	sessionRTT.DeletePartialMatch(labels)
+	reconnectAttempts.DeletePartialMatch(labels)
+	reconnectFailures.DeletePartialMatch(labels)
+	reconnectBackoff.DeletePartialMatch(labels)
+	certExpiryWarnings.DeletePartialMatch(labels)
+	connectDuration.DeletePartialMatch(labels)
+}
+
+// registerBuildInfo registers the metrics describing the running agent.
+func registerBuildInfo(registerer prometheus.Registerer, start time.Time) {
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coroot_connect_build_info",
+		Help: "A metric with a constant '1' value labeled by the version of the agent and the Go version it was built with",
+	}, []string{"version", "go_version"})
+	buildInfo.WithLabelValues(version, runtime.Version()).Set(1)
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "coroot_connect_start_time_seconds",
+		Help: "Start time of the agent since unix epoch in seconds",
+	})
+	startTime.Set(float64(start.Unix()))
+	registerer.MustRegister(buildInfo, startTime)
+}
+
+// destinationLabels bounds the cardinality of the destination label, as the destinations are chosen by the gateway.
+// The first limit destinations seen get their own label value, and the rest are collapsed into "other".
+type destinationLabels struct {
+	limit int
+	lock  sync.Mutex
+	seen  map[string]bool
+}
+
+func newDestinationLabels(limit int) *destinationLabels {
+	return &destinationLabels{limit: limit, seen: map[string]bool{}}
+}
+
+func (d *destinationLabels) label(destination string) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.seen[destination] {
+		return destination
+	}
+	if len(d.seen) >= d.limit {
+		return "other"
+	}
+	d.seen[destination] = true
+	return destination
+}
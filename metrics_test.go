@@ -0,0 +1,51 @@
+package connect
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBuildInfo(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	start := time.Unix(1700000000, 0)
+	registerBuildInfo(registry, start)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 2)
+
+	assert.Equal(t, "coroot_connect_build_info", families[0].GetName())
+	require.Len(t, families[0].GetMetric(), 1)
+	m := families[0].GetMetric()[0]
+	labels := map[string]string{}
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"version": version, "go_version": runtime.Version()}, labels)
+	assert.Equal(t, float64(1), m.GetGauge().GetValue())
+
+	assert.Equal(t, "coroot_connect_start_time_seconds", families[1].GetName())
+	assert.Equal(t, float64(1700000000), families[1].GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "\ngo_goroutines ")
+	assert.Contains(t, w.Body.String(), "\ncoroot_connect_auth_failures_total ")
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	unregisterRuntimeMetrics(registry)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, families)
+}
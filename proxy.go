@@ -0,0 +1,740 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"golang.org/x/net/proxy"
+	"io"
+	"k8s.io/klog"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errTunnelIdle      = errors.New("the tunnel is idle")
+	errGatewayGoAway   = errors.New("the gateway is going away")
+	errSessionRecycled = errors.New("the session has served the max number of streams")
+	drainPollInterval  = 100 * time.Millisecond
+	// portExhaustionPause is how long a proxy stops accepting new streams once it runs out of ephemeral ports
+	portExhaustionPause = time.Second
+)
+
+// DialFunc establishes connections to destinations, e.g. net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Proxy relays the streams opened by a gateway to their destinations.
+type Proxy struct {
+	settings *settings
+	dial     DialFunc
+	breaker  *circuitBreaker
+	// activeStreams is the number of the streams being proxied, accessed atomically.
+	activeStreams int64
+	// pausedUntil is the time in Unix nanoseconds until which new streams aren't accepted, accessed atomically.
+	pausedUntil int64
+	// bufferSize is the size of the buffers copying the data of each stream in either direction.
+	bufferSize int
+	// onStats, if set, receives the stats of the sessions sampled every sessionStatsInterval.
+	onStats func(gwConn net.Conn, stats SessionStats)
+}
+
+// SessionStats is a sample of the state of a gateway session.
+type SessionStats struct {
+	Streams   int       `json:"streams"`
+	RTT       Duration  `json:"rtt"`
+	SampledAt time.Time `json:"sampled_at"`
+}
+
+// NewProxy returns a proxy dialing the destinations with the settings of the config.
+func NewProxy(cfg *Config) *Proxy {
+	return newProxy(cfg.settings())
+}
+
+// NewProxyWithDialer returns a proxy dialing the destinations with dial rather than the dialer of the config.
+func NewProxyWithDialer(cfg *Config, dial DialFunc) *Proxy {
+	return newProxyWithDialer(cfg.settings(), dial)
+}
+
+func newProxy(s *settings) *Proxy {
+	d := &net.Dialer{Resolver: s.dnsResolver}
+	var dial DialFunc = d.DialContext
+	if s.destSocksProxy != "" {
+		dial = socksDialer(s.destSocksProxy, d)
+	}
+	tlsCfg := s.destTLSConfig()
+	return newProxyWithDialer(s, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, s.dialTimeoutFor(addr))
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.setNoDelay(conn)
+		if tlsCfg != nil && strings.HasPrefix(network, "tcp") {
+			return dialTLS(ctx, conn, addr, tlsCfg)
+		}
+		return conn, nil
+	})
+}
+
+// destTLSConfig returns the TLS config of the connections to the destinations, or nil if DEST_TLS is not set.
+func (s *settings) destTLSConfig() *tls.Config {
+	if !s.destTLS {
+		return nil
+	}
+	return &tls.Config{InsecureSkipVerify: s.destTLSSkipVerify, NextProtos: s.destTLSNextProtos}
+}
+
+// dialTLS performs the TLS handshake with the destination over conn, offering the DEST_TLS_NEXT_PROTOS protocols via ALPN.
+func dialTLS(ctx context.Context, conn net.Conn, addr string, cfg *tls.Config) (net.Conn, error) {
+	cfg = cfg.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		cfg.ServerName = host
+	}
+	c := tls.Client(conn, cfg)
+	if err := c.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %s", addr, err)
+	}
+	if klog.V(4) {
+		klog.Infof("connected to %s over TLS, negotiated protocol: %q", addr, c.ConnectionState().NegotiatedProtocol)
+	}
+	return c, nil
+}
+
+// socksDialer returns a DialFunc connecting to the destinations through the SOCKS5 proxy at proxyURL, validated by LoadConfig.
+// The destination names are resolved by the proxy, and only TCP destinations are supported.
+func socksDialer(proxyURL string, forward proxy.Dialer) DialFunc {
+	u, _ := url.Parse(proxyURL)
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	d, _ := proxy.SOCKS5("tcp", u.Host, auth, forward) // never fails
+	return d.(proxy.ContextDialer).DialContext
+}
+
+// setNoDelay applies tcpNoDelay to TCP connections, including those wrapped in TLS.
+func (s *settings) setNoDelay(conn net.Conn) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		if err := c.SetNoDelay(s.tcpNoDelay); err != nil {
+			klog.Warningf("failed to set TCP_NODELAY for the connection to %s: %s", c.RemoteAddr(), err)
+		}
+	}
+}
+
+// dialTimeoutFor returns the timeout of the first DEST_TIMEOUTS rule matching the host of the destination,
+// or the global timeout if none does.
+func (s *settings) dialTimeoutFor(addr string) time.Duration {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, r := range s.destTimeouts {
+		if ok, _ := path.Match(r.Pattern, host); ok {
+			return time.Duration(r.Timeout)
+		}
+	}
+	return s.timeout
+}
+
+func newProxyWithDialer(s *settings, dial DialFunc) *Proxy {
+	return &Proxy{
+		settings:   s,
+		dial:       dial,
+		breaker:    newCircuitBreaker(s.breakerThreshold, s.breakerWindow, s.breakerCooldown),
+		bufferSize: s.copyBufferSize,
+	}
+}
+
+// Serve accepts streams from the gateway connection until the context is canceled or the session fails.
+// Once the context is canceled, the gateway is asked not to open new streams, and Serve returns after the active ones complete.
+func (p *Proxy) Serve(ctx context.Context, gwConn net.Conn) error {
+	cfg := yamux.DefaultConfig()
+	cfg.KeepAliveInterval = p.settings.yamuxKeepAliveInterval
+	cfg.EnableKeepAlive = !p.settings.yamuxKeepAliveDisabled
+	cfg.ConnectionWriteTimeout = p.settings.yamuxWriteTimeout
+	// the streams opened by the gateway wait in the backlog until accepted, and yamux resets the ones that don't fit;
+	// a larger backlog absorbs bigger bursts at the cost of the memory held by the pending streams and their buffered data
+	cfg.AcceptBacklog = p.settings.yamuxAcceptBacklog
+	cfg.LogOutput = io.Discard
+	// the stats are reported for the connection as passed by the caller, not its wrappers
+	sessionConn := gwConn
+	if p.settings.gatewayReadTimeout > 0 {
+		gwConn = &watchdogConn{Conn: gwConn, timeout: p.settings.gatewayReadTimeout}
+	}
+	goAway := make(chan struct{})
+	gwConn = &goAwayConn{Conn: gwConn, received: goAway}
+	session, err := yamux.Server(gwConn, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to start a TCP multiplexing server: %s", err)
+	}
+	var goingAway int32
+	// recycle is closed once the session has served maxStreams streams
+	maxStreams, recycle := p.settings.maxStreamsPerSession, make(chan struct{})
+	drained := make(chan struct{})
+	defer func() {
+		_ = session.Close()
+		<-drained
+	}()
+	go func() {
+		defer close(drained)
+		select {
+		case <-goAway:
+			atomic.StoreInt32(&goingAway, 1)
+			klog.Infof("%s is going away, draining %d active streams", gwConn.RemoteAddr(), session.NumStreams())
+		case <-ctx.Done():
+			_ = session.GoAway()
+			klog.Infof("draining %d active streams from %s", session.NumStreams(), gwConn.RemoteAddr())
+		case <-recycle:
+			_ = session.GoAway()
+			klog.Infof(
+				"%d streams served over the connection to %s, draining %d active streams before recycling it",
+				maxStreams, gwConn.RemoteAddr(), session.NumStreams())
+		case <-session.CloseChan():
+			return
+		}
+		drain(session, p.settings.streamTimeout)
+		_ = session.Close()
+	}()
+	if p.onStats != nil && p.settings.sessionStatsInterval > 0 {
+		go p.sampleStats(session, sessionConn, p.settings.sessionStatsInterval)
+	}
+	var idle *time.Timer
+	var isIdle int32
+	if p.settings.tunnelMaxIdle > 0 {
+		idle = time.AfterFunc(p.settings.tunnelMaxIdle, func() {
+			if session.NumStreams() > 0 {
+				idle.Reset(p.settings.tunnelMaxIdle)
+				return
+			}
+			atomic.StoreInt32(&isIdle, 1)
+			_ = session.Close()
+		})
+		defer idle.Stop()
+	}
+	var slots chan struct{}
+	if p.settings.maxConcurrentStreams > 0 {
+		slots = make(chan struct{}, p.settings.maxConcurrentStreams)
+	}
+	served := 0
+	for {
+		gwStream, err := session.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if atomic.LoadInt32(&isIdle) == 1 {
+				return errTunnelIdle
+			}
+			if atomic.LoadInt32(&goingAway) == 1 {
+				return errGatewayGoAway
+			}
+			if maxStreams > 0 && served >= maxStreams {
+				return errSessionRecycled
+			}
+			return fmt.Errorf("failed to accept a stream: %s", err)
+		}
+		if idle != nil {
+			idle.Reset(p.settings.tunnelMaxIdle)
+		}
+		// the streams opened by the gateway meanwhile wait in the accept backlog
+		if d := p.pausedFor(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			case <-session.CloseChan():
+			}
+		}
+		if slots == nil {
+			go p.handleStream(gwStream)
+		} else {
+			select {
+			case slots <- struct{}{}:
+				go func() {
+					defer func() { <-slots }()
+					p.handleStream(gwStream)
+				}()
+			default:
+				go p.rejectStream(gwStream, cap(slots))
+				// a rejected stream doesn't count towards MAX_STREAMS_PER_SESSION
+				continue
+			}
+		}
+		served++
+		if maxStreams > 0 && served == maxStreams {
+			close(recycle)
+		}
+	}
+}
+
+// rejectStream lets the gateway know that the session has reached the limit of the concurrent streams.
+func (p *Proxy) rejectStream(c net.Conn, limit int) {
+	defer c.Close()
+	streamsRejected.Inc()
+	_ = c.SetDeadline(time.Now().Add(p.settings.handshakeTimeout))
+	header, err := readStreamHeader(c, p.settings.maxDestinationSize)
+	if err != nil {
+		return
+	}
+	header.streamID = streamID(c)
+	klog.Warningf("the session has reached %d concurrent streams, rejecting the stream to %s", limit, header)
+	writeStreamError(c, header, StreamStatusUnavailable, fmt.Sprintf("the session has reached %d concurrent streams", limit))
+}
+
+// sessionMemoryBound returns the upper bound of the memory used by the streams of a gateway session:
+// each stream buffers up to the yamux receive window and holds the buffers copying the data in both directions,
+// which are datagram-sized for UDP streams. It returns 0 if the number of the streams isn't limited.
+func (s *settings) sessionMemoryBound() int {
+	if s.maxConcurrentStreams <= 0 {
+		return 0
+	}
+	buffers := 2 * s.copyBufferSize
+	if udp := 2 * math.MaxUint16; udp > buffers {
+		buffers = udp
+	}
+	return s.maxConcurrentStreams * (int(yamux.DefaultConfig().MaxStreamWindowSize) + buffers)
+}
+
+// logMemoryBound logs the upper bound of the memory used by the streams of each gateway session to help size the agent.
+func (s *settings) logMemoryBound() {
+	bound := s.sessionMemoryBound()
+	if bound == 0 {
+		klog.Infoln("the memory used by the streams of the gateway sessions is unbounded, set MAX_CONCURRENT_STREAMS to limit it")
+		return
+	}
+	klog.Infof("the streams of each gateway session use up to %.1f MiB: %d concurrent streams with %d byte copy buffers",
+		float64(bound)/(1<<20), s.maxConcurrentStreams, s.copyBufferSize)
+}
+
+// ActiveStreams returns the number of the streams being proxied.
+func (p *Proxy) ActiveStreams() int64 {
+	return atomic.LoadInt64(&p.activeStreams)
+}
+
+// sampleStats measures the RTT of the session with pings until the session is closed.
+func (p *Proxy) sampleStats(session *yamux.Session, gwConn net.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+		rtt, err := session.Ping()
+		if err != nil {
+			klog.V(2).Infof("failed to ping %s: %s", gwConn.RemoteAddr(), err)
+			continue
+		}
+		p.onStats(gwConn, SessionStats{Streams: session.NumStreams(), RTT: Duration(rtt), SampledAt: time.Now()})
+	}
+}
+
+// drain waits for the active streams of the session to complete.
+func drain(session *yamux.Session, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for session.NumStreams() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+func (p *Proxy) handleStream(c net.Conn) {
+	atomic.AddInt64(&p.activeStreams, 1)
+	defer atomic.AddInt64(&p.activeStreams, -1)
+	defer c.Close()
+	header := &StreamHeader{streamID: streamID(c)}
+	destination := header.String()
+	defer func() {
+		if r := recover(); r != nil {
+			streamPanicsTotal.Inc()
+			klog.Errorf("panic while proxying a stream to %s: %v\n%s", destination, r, debug.Stack())
+		}
+	}()
+	deadline := time.Now().Add(p.settings.streamTimeout)
+	if err := c.SetDeadline(deadline); err != nil {
+		klog.Errorf("failed to set a deadline for the stream to %s: %s", header, err)
+		return
+	}
+	// a gateway sends the header right after opening the stream, so a stalled header doesn't hold the stream until the deadline
+	if err := c.SetReadDeadline(time.Now().Add(p.settings.handshakeTimeout)); err != nil {
+		klog.Errorf("failed to set a deadline for the header of the stream to %s: %s", header, err)
+		return
+	}
+	h, err := readStreamHeader(c, p.settings.maxDestinationSize)
+	if err != nil {
+		klog.Warningf("protocol error on the stream to %s: %s", header, err)
+		return
+	}
+	h.streamID = header.streamID
+	header = h
+	// a stream already closed by the gateway is handled by the copying below
+	_ = c.SetReadDeadline(deadline)
+	if name := header.Metadata[StreamMetadataTarget]; name != "" {
+		addr, ok := p.settings.targets[name]
+		if !ok {
+			klog.Warningf("unknown target %q requested on the stream to %s", name, header)
+			writeStreamError(c, header, StreamStatusUnknownTarget, fmt.Sprintf("unknown target %q", name))
+			return
+		}
+		header.Destination = addr
+	}
+	destination = header.String()
+	destAddress := header.Destination
+	network := "tcp"
+	if strings.HasPrefix(destAddress, "udp://") {
+		network = "udp"
+		destAddress = strings.TrimPrefix(destAddress, "udp://")
+	}
+	klog.V(4).Infof("proxying a stream to %s", header)
+	// the targets are configured by the operator, so they are allowed regardless of the allow lists
+	if header.Metadata[StreamMetadataTarget] == "" && !p.settings.destinationAllowed(destAddress) {
+		klog.Warningf("the connection to %s is not allowed", header)
+		writeStreamError(c, header, StreamStatusForbidden, fmt.Sprintf("%s is not allowed", destAddress))
+		return
+	}
+	if !p.breaker.allow(header.Destination) {
+		klog.V(2).Infof("the recent connections to %s have failed, failing the stream", header)
+		writeStreamError(c, header, StreamStatusUnavailable, fmt.Sprintf("%s is unavailable, the recent connections have failed", destAddress))
+		return
+	}
+	label := p.settings.destinations.label(header.Destination)
+	if !p.settings.rateLimiter.allow(header.Destination) {
+		destinationRateLimited.WithLabelValues(label).Inc()
+		klog.V(2).Infof("the streams to %s exceed %d per second, rejecting the stream", header, p.settings.rateLimiter.limit)
+		writeStreamError(c, header, StreamStatusRateLimited, fmt.Sprintf("the streams to %s exceed %d per second", destAddress, p.settings.rateLimiter.limit))
+		return
+	}
+	destinationStreams.WithLabelValues(label).Inc()
+	if network == "udp" {
+		p.proxyUDP(c, destAddress, header)
+		return
+	}
+	destConn, err := p.dial(context.Background(), p.settings.destDialNetwork, destAddress)
+	if err != nil {
+		p.dialFailed(c, header, err)
+		return
+	}
+	p.breaker.succeeded(header.Destination)
+	defer destConn.Close()
+	// streamTimeout limits the time without any data relayed in either direction rather than the duration of the stream,
+	// so that long transfers, such as large remote-write requests over a slow link, aren't interrupted while active
+	_ = c.SetDeadline(time.Time{})
+	var lastActivity int64
+	touch := func() {
+		atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+	}
+	touch()
+	var idle *time.Timer
+	var expired int32
+	idle = time.AfterFunc(p.settings.streamTimeout, func() {
+		if d := p.settings.streamTimeout - time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity))); d > 0 {
+			idle.Reset(d)
+			return
+		}
+		atomic.StoreInt32(&expired, 1)
+		_ = c.Close()
+		_ = destConn.Close()
+	})
+	defer idle.Stop()
+	if p.settings.sendProxyProtocol {
+		src, _ := netip.ParseAddrPort(header.Metadata[StreamMetadataSource])
+		dst, _ := netip.ParseAddrPort(destConn.RemoteAddr().String())
+		if _, err = destConn.Write(proxyProtocolHeader(src, dst)); err != nil {
+			klog.Errorf("failed to send the PROXY protocol header to %s: %s", header, err)
+			return
+		}
+	}
+	start := time.Now()
+	downloaded := make(chan int64, 1)
+	go func() {
+		n, err := io.CopyBuffer(c, activityReader{Reader: destConn, touch: touch}, make([]byte, p.bufferSize))
+		copyFailed(header, "down", err)
+		downloaded <- n
+	}()
+	// destConn is wrapped not to copy with its ReadFrom, which would allocate a buffer of its own
+	up, err := io.CopyBuffer(writerOnly{destConn}, activityReader{Reader: c, touch: touch}, make([]byte, p.bufferSize))
+	copyFailed(header, "up", err)
+	_ = destConn.Close()
+	down := <-downloaded
+	destinationBytes.WithLabelValues(label, "up").Add(float64(up))
+	destinationBytes.WithLabelValues(label, "down").Add(float64(down))
+	if atomic.LoadInt32(&expired) == 1 {
+		// reported with the amount of data relayed to help to tell a stalled destination from a STREAM_TIMEOUT too short for it
+		streamTimeouts.WithLabelValues(label).Inc()
+		klog.Warningf("stream exceeded max lifetime: no data relayed to or from %s within %s, closed after %s with %d bytes up and %d bytes down",
+			header, p.settings.streamTimeout, time.Since(start).Truncate(time.Millisecond), up, down)
+		return
+	}
+	klog.V(4).Infof("stream to %s completed: %d bytes up, %d bytes down in %s", header, up, down, time.Since(start))
+}
+
+// streamID returns the yamux ID of the stream, 0 if it isn't a yamux stream.
+func streamID(c net.Conn) uint32 {
+	if s, ok := c.(interface{ StreamID() uint32 }); ok {
+		return s.StreamID()
+	}
+	return 0
+}
+
+// writerOnly hides all the methods of the writer but Write.
+type writerOnly struct {
+	io.Writer
+}
+
+// activityReader calls touch on each read of data.
+type activityReader struct {
+	io.Reader
+	touch func()
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
+
+// proxyUDP relays datagrams between the stream and a UDP destination.
+// Each datagram is framed on the stream with its uint16 length.
+// Since UDP has no connection semantics, the stream is closed once no datagrams have been seen in either direction within udpIdleTimeout.
+func (p *Proxy) proxyUDP(c net.Conn, destAddress string, header *StreamHeader) {
+	destConn, err := p.dial(context.Background(), "udp", destAddress)
+	if err != nil {
+		p.dialFailed(c, header, err)
+		return
+	}
+	p.breaker.succeeded(header.Destination)
+	defer destConn.Close()
+
+	var lastActivity int64
+	touch := func() {
+		atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+	}
+	touch()
+
+	go func() {
+		defer c.Close()
+		buf := make([]byte, math.MaxUint16)
+		for {
+			if err := destConn.SetReadDeadline(time.Now().Add(p.settings.udpIdleTimeout)); err != nil {
+				return
+			}
+			n, err := destConn.Read(buf)
+			if err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					if time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity))) < p.settings.udpIdleTimeout {
+						continue
+					}
+				}
+				return
+			}
+			touch()
+			if err := binary.Write(c, binary.LittleEndian, uint16(n)); err != nil {
+				return
+			}
+			if _, err := c.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, math.MaxUint16)
+	for {
+		var size uint16
+		if err := binary.Read(c, binary.LittleEndian, &size); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, buf[:size]); err != nil {
+			return
+		}
+		touch()
+		if _, err := destConn.Write(buf[:size]); err != nil {
+			klog.Errorf("failed to send a datagram to %s: %s", header, err)
+			return
+		}
+	}
+}
+
+// pausedFor returns how long new streams aren't accepted for.
+func (p *Proxy) pausedFor() time.Duration {
+	return time.Until(time.Unix(0, atomic.LoadInt64(&p.pausedUntil)))
+}
+
+// dialFailed reports the failed connection to the destination to the gateway and accounts it by the reason.
+func (p *Proxy) dialFailed(c net.Conn, header *StreamHeader, err error) {
+	reason := classifyDialError(err)
+	destinationDialErrors.WithLabelValues(reason).Inc()
+	if reason == "ports_exhausted" {
+		// the destination isn't at fault, so the breaker isn't involved
+		until := time.Now().Add(portExhaustionPause).UnixNano()
+		if prev := atomic.SwapInt64(&p.pausedUntil, until); prev < time.Now().UnixNano() {
+			klog.Warningf(
+				"ephemeral port exhaustion while connecting to %s: %s; pausing accepting new streams for %s. "+
+					"Reduce the scrape concurrency, or widen net.ipv4.ip_local_port_range and enable net.ipv4.tcp_tw_reuse",
+				header, err, portExhaustionPause)
+		}
+		writeStreamError(c, header, StreamStatusUnreachable, err.Error())
+		return
+	}
+	klog.Errorf("failed to establish a connection to %s (%s): %s", header, reason, err)
+	if p.breaker.failed(header.Destination) {
+		klog.Warningf("%d connections to %s have failed in a row, failing the streams to it for %s", p.settings.breakerThreshold, header, p.settings.breakerCooldown)
+	}
+	writeStreamError(c, header, StreamStatusUnreachable, err.Error())
+}
+
+// classifyDialError tells a destination that can't be resolved from one that is down or doesn't respond,
+// and both from the agent running out of ephemeral ports.
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "ports_exhausted"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// copyFailed records an error that ended copying the data of a stream in the given direction.
+// The errors caused by closing the stream on our side are a normal closure and aren't recorded.
+func copyFailed(header *StreamHeader, direction string, err error) {
+	reason := classifyCopyError(err)
+	if reason == "" {
+		return
+	}
+	streamCopyErrors.WithLabelValues(direction, reason).Inc()
+	klog.V(4).Infof("copying the stream to %s (%s) failed: %s: %s", header, direction, reason, err)
+}
+
+func classifyCopyError(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, net.ErrClosed), errors.Is(err, yamux.ErrStreamClosed):
+		return ""
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, yamux.ErrConnectionReset):
+		return "reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+func (s *settings) destinationAllowed(addr string) bool {
+	if len(s.allowedDestinations) == 0 && len(s.allowedPorts) == 0 {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if len(s.allowedPorts) > 0 {
+		if p, err := strconv.Atoi(port); err != nil || !s.allowedPorts[p] {
+			return false
+		}
+	}
+	if len(s.allowedDestinations) == 0 {
+		return true
+	}
+	for _, a := range s.allowedDestinations {
+		if a == addr || a == host {
+			return true
+		}
+	}
+	return false
+}
+
+// watchdogConn fails reads if nothing has been received from the gateway within the timeout.
+// Since yamux keepalive pings are answered by the gateway, a silent connection is most likely half-open.
+type watchdogConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *watchdogConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		klog.Warningf("no data received from %s within %s, the connection seems to be half-open", c.RemoteAddr(), c.timeout)
+	}
+	return n, err
+}
+
+const (
+	yamuxHeaderSize = 12
+	yamuxTypeData   = 0
+	yamuxTypeGoAway = 3
+)
+
+// goAwayConn follows the yamux frames read from the gateway and closes the received channel on a GoAway frame.
+// yamux handles GoAway internally and doesn't expose it, while the agent has to know that the gateway is shedding load.
+type goAwayConn struct {
+	net.Conn
+	received chan struct{}
+
+	header    [yamuxHeaderSize]byte
+	headerLen int
+	remaining uint32
+}
+
+func (c *goAwayConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for data := b[:n]; len(data) > 0; {
+		if c.remaining > 0 {
+			skip := uint32(len(data))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			c.remaining -= skip
+			data = data[skip:]
+			continue
+		}
+		copied := copy(c.header[c.headerLen:], data)
+		c.headerLen += copied
+		data = data[copied:]
+		if c.headerLen < yamuxHeaderSize {
+			break
+		}
+		c.headerLen = 0
+		switch c.header[1] {
+		case yamuxTypeData:
+			c.remaining = binary.BigEndian.Uint32(c.header[8:12])
+		case yamuxTypeGoAway:
+			select {
+			case <-c.received:
+			default:
+				close(c.received)
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,1035 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// pipeDialer returns in-memory connections and passes the destination side of each to the handler.
+func pipeDialer(handler func(network, addr string, conn net.Conn)) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		agentSide, destSide := net.Pipe()
+		go handler(network, addr, destSide)
+		return agentSide, nil
+	}
+}
+
+// serveStream runs the proxy on an in-memory stream and returns the gateway side of it.
+func serveStream(p *Proxy) net.Conn {
+	gwSide, agentSide := net.Pipe()
+	go p.handleStream(agentSide)
+	return gwSide
+}
+
+func TestProxyWithInMemoryDialer(t *testing.T) {
+	p := newProxyWithDialer(testSettings(), pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "%s %s %s", network, addr, buf)
+	}))
+
+	stream := serveStream(p)
+	defer stream.Close()
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus:9090"}))
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	data := make([]byte, len("tcp prometheus:9090 ping"))
+	_, err = io.ReadFull(stream, data)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp prometheus:9090 ping", string(data))
+}
+
+func TestStreamCompletionLogging(t *testing.T) {
+	logs := captureLogs(t)
+	defer setLogLevel(0)
+	require.NoError(t, setLogLevel(4))
+	p := newProxyWithDialer(testSettings(), pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = conn.Write([]byte("pong"))
+	}))
+
+	stream := serveStream(p)
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus:9090"}))
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(stream, make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	re := regexp.MustCompile(`stream to prometheus:9090 completed: 4 bytes up, 4 bytes down in (\S+)`)
+	var m []string
+	require.Eventually(t, func() bool {
+		m = re.FindStringSubmatch(logs.String())
+		return m != nil
+	}, time.Second, 10*time.Millisecond)
+	d, err := time.ParseDuration(m[1])
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, d, 10*time.Millisecond)
+}
+
+func TestStreamLoggingLevel(t *testing.T) {
+	logs := captureLogs(t)
+	p := newProxyWithDialer(testSettings(), pipeDialer(func(network, addr string, conn net.Conn) {
+		_ = conn.Close()
+	}))
+	defer setLogLevel(0)
+	for _, level := range []int{3, 4} {
+		require.NoError(t, setLogLevel(level))
+		stream, agentSide := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			p.handleStream(agentSide)
+			close(done)
+		}()
+		_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: fmt.Sprintf("level%d:9090", level)}))
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		<-done
+	}
+	assert.NotContains(t, logs.String(), "level3:9090")
+	assert.Contains(t, logs.String(), "stream to level4:9090 completed")
+}
+
+func TestProxyAllowlistWithInMemoryDialer(t *testing.T) {
+	s := testSettings()
+	s.allowedDestinations = []string{"prometheus:9090"}
+	dialed := make(chan string, 1)
+	p := newProxyWithDialer(s, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return nil, fmt.Errorf("dial tcp %s: connect: connection refused", addr)
+	})
+
+	stream := serveStream(p)
+	defer stream.Close()
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: "node-exporter:9100", Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+	require.NoError(t, err)
+	status, message := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusForbidden, status)
+	assert.Equal(t, "node-exporter:9100 is not allowed", message)
+	assert.Len(t, dialed, 0)
+
+	stream = serveStream(p)
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus:9090", Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+	require.NoError(t, err)
+	status, message = readStreamError(t, stream)
+	assert.Equal(t, StreamStatusUnreachable, status)
+	assert.Equal(t, "dial tcp prometheus:9090: connect: connection refused", message)
+	assert.Equal(t, "prometheus:9090", <-dialed)
+
+	// a gateway that hasn't opted in to the error frames can't tell them from the destination's data
+	stream = serveStream(p)
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: "node-exporter:9100"}))
+	require.NoError(t, err)
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestStreamErrors(t *testing.T) {
+	s := testSettings()
+	s.allowedDestinations = []string{"127.0.0.1:1", "localhost"}
+	session := startProxy(t, s)
+
+	stream, err := openStream(session, "127.0.0.1:1")
+	require.NoError(t, err)
+	status, message := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusUnreachable, status)
+	assert.Contains(t, message, "connection refused")
+
+	stream, err = openStream(session, "127.0.0.1:2")
+	require.NoError(t, err)
+	status, message = readStreamError(t, stream)
+	assert.Equal(t, StreamStatusForbidden, status)
+	assert.Equal(t, "127.0.0.1:2 is not allowed", message)
+
+	assert.True(t, s.destinationAllowed("localhost:9090"))
+	assert.False(t, s.destinationAllowed("localhost"))
+}
+
+func TestProxyUDP(t *testing.T) {
+	s := testSettings()
+	s.udpIdleTimeout = 200 * time.Millisecond
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	session := startProxy(t, s)
+	stream, err := openStream(session, "udp://"+echo.LocalAddr().String())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	for _, payload := range []string{"ping", "foo:1|c"} {
+		require.NoError(t, binary.Write(stream, binary.LittleEndian, uint16(len(payload))))
+		_, err = stream.Write([]byte(payload))
+		require.NoError(t, err)
+
+		var size uint16
+		require.NoError(t, binary.Read(stream, binary.LittleEndian, &size))
+		buf := make([]byte, int(size))
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		assert.Equal(t, payload, string(buf))
+	}
+
+	// the stream is closed once idle
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAllowedPorts(t *testing.T) {
+	s := testSettings()
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Prometheus is Healthy.")
+	}))
+	defer prometheus.Close()
+	_, port, err := net.SplitHostPort(prometheus.Listener.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	s.allowedPorts = map[int]bool{p: true}
+
+	session := startProxy(t, s)
+	assert.Equal(t, "Prometheus is Healthy.", httpGet(t, session, prometheus.Listener.Addr().String()))
+
+	stream, err := openStream(session, "127.0.0.1:22")
+	require.NoError(t, err)
+	status, message := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusForbidden, status)
+	assert.Equal(t, "127.0.0.1:22 is not allowed", message)
+}
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestGoAwayConn(t *testing.T) {
+	frame := func(typ byte, length uint32, payload []byte) []byte {
+		h := make([]byte, yamuxHeaderSize)
+		h[1] = typ
+		binary.BigEndian.PutUint32(h[8:12], length)
+		return append(h, payload...)
+	}
+	goAway := frame(yamuxTypeGoAway, 0, nil)
+
+	var data []byte
+	data = append(data, frame(yamuxTypeData, uint32(len(goAway)), goAway)...)
+	data = append(data, frame(1, 1024, nil)...)
+
+	received := make(chan struct{})
+	c := &goAwayConn{Conn: &readerConn{r: iotest.OneByteReader(bytes.NewReader(data))}, received: received}
+	_, err := io.ReadAll(c)
+	require.NoError(t, err)
+	select {
+	case <-received:
+		t.Fatal("a GoAway frame in the stream data must be ignored")
+	default:
+	}
+
+	c.Conn = &readerConn{r: bytes.NewReader(append(goAway, goAway...))}
+	_, err = io.ReadAll(c)
+	require.NoError(t, err)
+	select {
+	case <-received:
+	default:
+		t.Fatal("the GoAway frame hasn't been detected")
+	}
+}
+
+func TestStreamPanicRecovery(t *testing.T) {
+	logs := captureLogs(t)
+	p := newProxyWithDialer(testSettings(), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "panic:1" {
+			panic("boom")
+		}
+		return pipeDialer(func(network, addr string, conn net.Conn) {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		})(ctx, network, addr)
+	})
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	go func() {
+		_ = p.Serve(context.Background(), agentSide)
+	}()
+	session, err := yamux.Client(gwSide, yamux.DefaultConfig())
+	require.NoError(t, err)
+	defer session.Close()
+
+	panics := testutil.ToFloat64(streamPanicsTotal)
+	stream, err := openStream(session, "panic:1")
+	require.NoError(t, err)
+	_, err = io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, panics+1, testutil.ToFloat64(streamPanicsTotal))
+	assert.Contains(t, logs.String(), "panic while proxying a stream to panic:1 (stream_id=1): boom")
+
+	stream, err = openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	data := make([]byte, 4)
+	_, err = io.ReadFull(stream, data)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
+
+func TestClassifyDialError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	d := &net.Dialer{}
+	_, err = d.Dial("tcp", closed)
+	require.Error(t, err)
+	assert.Equal(t, "refused", classifyDialError(err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = d.DialContext(ctx, "tcp", closed)
+	require.Error(t, err)
+	assert.Equal(t, "timeout", classifyDialError(err))
+
+	_, err = d.Dial("tcp", "prometheus.invalid:9090")
+	require.Error(t, err)
+	assert.Equal(t, "dns", classifyDialError(err))
+
+	err = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+	assert.Equal(t, "ports_exhausted", classifyDialError(err))
+
+	assert.Equal(t, "other", classifyDialError(fmt.Errorf("unexpected")))
+}
+
+func TestDestinationDialErrors(t *testing.T) {
+	logs := captureLogs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	refused := testutil.ToFloat64(destinationDialErrors.WithLabelValues("refused"))
+	stream := serveStream(newProxy(testSettings()))
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: closed, Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+	require.NoError(t, err)
+	status, _ := readStreamError(t, stream)
+	assert.Equal(t, uint16(StreamStatusUnreachable), status)
+	assert.Equal(t, refused+1, testutil.ToFloat64(destinationDialErrors.WithLabelValues("refused")))
+	assert.Contains(t, logs.String(), "failed to establish a connection to "+closed+" (refused)")
+}
+
+func TestStreamCopyErrors(t *testing.T) {
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer destination.Close()
+	go func() {
+		conn, err := destination.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("partial response"))
+		_ = conn.(*net.TCPConn).SetLinger(0) // the connection is reset on close
+		_ = conn.Close()
+	}()
+
+	resets := testutil.ToFloat64(streamCopyErrors.WithLabelValues("down", "reset"))
+	stream := serveStream(newProxy(testSettings()))
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: destination.Addr().String()}))
+	require.NoError(t, err)
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+	}()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(streamCopyErrors.WithLabelValues("down", "reset")) == resets+1
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, stream.Close())
+
+	assert.Equal(t, "", classifyCopyError(nil))
+	assert.Equal(t, "", classifyCopyError(fmt.Errorf("read: %w", net.ErrClosed)))
+	assert.Equal(t, "reset", classifyCopyError(yamux.ErrConnectionReset))
+	assert.Equal(t, "timeout", classifyCopyError(os.ErrDeadlineExceeded))
+}
+
+func TestTargets(t *testing.T) {
+	s := testSettings()
+	s.targets = map[string]string{"main": "prometheus-main:9090", "longterm": "prometheus-longterm:9090"}
+	s.allowedDestinations = []string{"node-exporter"}
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s %s", network, addr)
+	}))
+
+	stream := serveStream(p)
+	defer stream.Close()
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Metadata: map[string]string{StreamMetadataTarget: "longterm"}}))
+	require.NoError(t, err)
+	data := make([]byte, len("tcp prometheus-longterm:9090"))
+	_, err = io.ReadFull(stream, data)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp prometheus-longterm:9090", string(data))
+
+	stream = serveStream(p)
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus-main:9090", Metadata: map[string]string{StreamMetadataTarget: "unknown", StreamMetadataErrorFrames: "true"}}))
+	require.NoError(t, err)
+	status, message := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusUnknownTarget, status)
+	assert.Equal(t, `unknown target "unknown"`, message)
+}
+
+func TestDestinationLabels(t *testing.T) {
+	s := testSettings()
+	s.destinations = newDestinationLabels(2)
+	other := testutil.ToFloat64(destinationStreams.WithLabelValues("other"))
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ok"))
+	}))
+	for _, dest := range []string{"labeled-a:80", "labeled-b:80", "overflow-c:80", "labeled-a:80"} {
+		stream := serveStream(p)
+		_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: dest}))
+		require.NoError(t, err)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+	}
+	assert.Equal(t, "other", s.destinations.label("overflow-d:80"))
+	assert.Equal(t, float64(2), testutil.ToFloat64(destinationStreams.WithLabelValues("labeled-a:80")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(destinationStreams.WithLabelValues("labeled-b:80")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(destinationStreams.WithLabelValues("overflow-c:80")))
+	assert.Equal(t, other+1, testutil.ToFloat64(destinationStreams.WithLabelValues("other")))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(destinationBytes.WithLabelValues("labeled-a:80", "down")) == 4
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDestTimeouts(t *testing.T) {
+	s := testSettings()
+	s.timeout = 5 * time.Second
+	s.destTimeouts = []DestTimeout{
+		{Pattern: "*.s3.amazonaws.com", Timeout: Duration(30 * time.Second)},
+		{Pattern: "prometheus", Timeout: Duration(time.Second)},
+	}
+
+	assert.Equal(t, 30*time.Second, s.dialTimeoutFor("bucket.s3.amazonaws.com:443"))
+	assert.Equal(t, time.Second, s.dialTimeoutFor("prometheus:9090"))
+	assert.Equal(t, 5*time.Second, s.dialTimeoutFor("victoria-metrics:8428"))
+	assert.Equal(t, 5*time.Second, s.dialTimeoutFor("s3.amazonaws.com:443"))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := testSettings()
+	s.breakerThreshold, s.breakerWindow, s.breakerCooldown = 3, time.Minute, 300*time.Millisecond
+
+	var dials int32
+	var down int32 = 1
+	p := newProxyWithDialer(s, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, syscall.ECONNREFUSED
+		}
+		agentSide, destSide := net.Pipe()
+		go func() {
+			defer destSide.Close()
+			_, _ = destSide.Write([]byte("ok"))
+		}()
+		return agentSide, nil
+	})
+	open := func() uint16 {
+		stream := serveStream(p)
+		defer stream.Close()
+		_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus:9090", Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+		require.NoError(t, err)
+		status, _ := readStreamError(t, stream)
+		return status
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, StreamStatusUnreachable, open())
+	}
+	assert.Equal(t, StreamStatusUnavailable, open())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(s.breakerCooldown)
+	stream := serveStream(p)
+	defer stream.Close()
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: "prometheus:9090", Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&dials))
+	assert.True(t, p.breaker.allow("prometheus:9090"))
+}
+
+func TestAcceptBacklogBurst(t *testing.T) {
+	s := testSettings()
+	s.yamuxAcceptBacklog = 1024
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}))
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	go func() {
+		_ = p.Serve(context.Background(), agentSide)
+	}()
+	cfg := yamux.DefaultConfig()
+	cfg.AcceptBacklog = s.yamuxAcceptBacklog
+	session, err := yamux.Client(gwSide, cfg)
+	require.NoError(t, err)
+	defer session.Close()
+
+	const burst = 1000
+	streams := make([]net.Conn, 0, burst)
+	for i := 0; i < burst; i++ {
+		stream, err := openStream(session, fmt.Sprintf("prometheus-%d:9090", i))
+		require.NoError(t, err)
+		streams = append(streams, stream)
+	}
+	for _, stream := range streams {
+		_, err = stream.Write([]byte("ping"))
+		require.NoError(t, err)
+		data := make([]byte, 4)
+		_, err = io.ReadFull(stream, data)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(data))
+		require.NoError(t, stream.Close())
+	}
+}
+
+func TestStalledStreamHeader(t *testing.T) {
+	logs := captureLogs(t)
+	s := testSettings()
+	s.handshakeTimeout = 200 * time.Millisecond
+
+	stream := serveStream(newProxy(s))
+	defer stream.Close()
+	start := time.Now()
+	_, err := stream.Write([]byte{200, 0})
+	require.NoError(t, err)
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Contains(t, logs.String(), "protocol error on the stream to unknown destination: failed to read the destination address")
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	s := testSettings()
+	s.streamTimeout = 300 * time.Millisecond
+
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer destination.Close()
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.CopyN(io.Discard, conn, 16*64*1024)
+				fmt.Fprintf(conn, "%d", n)
+			}()
+		}
+	}()
+
+	// the streams are waited for, so that they don't outlive the test
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	serve := func() net.Conn {
+		gwSide, agentSide := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newProxy(s).handleStream(agentSide)
+		}()
+		return gwSide
+	}
+	stream := serve()
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: destination.Addr().String()}))
+	require.NoError(t, err)
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	start := time.Now()
+	for i := 0; i < 16; i++ {
+		_, err = stream.Write(chunk)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Greater(t, time.Since(start), 3*s.streamTimeout)
+	resp := make([]byte, len(strconv.Itoa(16*len(chunk))))
+	_, err = io.ReadFull(stream, resp)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(16*len(chunk)), string(resp))
+
+	idle := serve()
+	defer idle.Close()
+	_, err = idle.Write(encodeStreamHeader(StreamHeader{Destination: destination.Addr().String()}))
+	require.NoError(t, err)
+	start = time.Now()
+	_, err = io.ReadAll(idle)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), s.streamTimeout)
+}
+
+func TestStreamTimeoutReported(t *testing.T) {
+	logs := captureLogs(t)
+	s := testSettings()
+	s.streamTimeout = 200 * time.Millisecond
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("partial"))
+		_, _ = io.Copy(io.Discard, conn) // stalls until the stream is closed
+	}))
+	dest := "slow-exporter:9100"
+	timeouts := streamTimeouts.WithLabelValues(s.destinations.label(dest))
+	before := testutil.ToFloat64(timeouts)
+
+	// the stream is waited for, so that it doesn't outlive the test
+	gwSide, agentSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handleStream(agentSide)
+	}()
+	defer gwSide.Close()
+	_, err := gwSide.Write(encodeStreamHeader(StreamHeader{Destination: dest}))
+	require.NoError(t, err)
+	data, err := io.ReadAll(gwSide)
+	require.NoError(t, err)
+	assert.Equal(t, "partial", string(data))
+	<-done
+
+	assert.Equal(t, before+1, testutil.ToFloat64(timeouts))
+	assert.Regexp(t, `stream exceeded max lifetime: no data relayed to or from slow-exporter:9100 within 200ms, closed after \d+ms with 0 bytes up and 7 bytes down`, logs.String())
+}
+
+func TestPortExhaustion(t *testing.T) {
+	defer func(pause time.Duration) {
+		portExhaustionPause = pause
+	}(portExhaustionPause)
+	portExhaustionPause = 300 * time.Millisecond
+	logs := captureLogs(t)
+
+	var exhausted int32 = 1
+	p := newProxyWithDialer(testSettings(), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.CompareAndSwapInt32(&exhausted, 1, 0) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+		}
+		agentSide, destSide := net.Pipe()
+		go func() {
+			defer destSide.Close()
+			_, _ = destSide.Write([]byte("ok"))
+		}()
+		return agentSide, nil
+	})
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	go func() {
+		_ = p.Serve(context.Background(), agentSide)
+	}()
+	session, err := yamux.Client(gwSide, nil)
+	require.NoError(t, err)
+	defer session.Close()
+
+	before := testutil.ToFloat64(destinationDialErrors.WithLabelValues("ports_exhausted"))
+	stream, err := openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	status, _ := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusUnreachable, status)
+	_ = stream.Close()
+	assert.Equal(t, before+1, testutil.ToFloat64(destinationDialErrors.WithLabelValues("ports_exhausted")))
+	assert.Contains(t, logs.String(), "ephemeral port exhaustion while connecting to prometheus:9090")
+	assert.True(t, p.breaker.allow("prometheus:9090"))
+
+	start := time.Now()
+	stream, err = openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	defer stream.Close()
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestStreamIDLogging(t *testing.T) {
+	logs := captureLogs(t)
+	p := newProxyWithDialer(testSettings(), pipeDialer(func(network, addr string, conn net.Conn) {
+		_ = conn.Close()
+	}))
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	go func() {
+		_ = p.Serve(context.Background(), agentSide)
+	}()
+	session, err := yamux.Client(gwSide, nil)
+	require.NoError(t, err)
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, binary.Write(stream, binary.LittleEndian, uint16(1000)))
+	expected := fmt.Sprintf("protocol error on the stream to unknown destination (stream_id=%d): implausible destination size", stream.StreamID())
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), expected)
+	}, time.Second, 10*time.Millisecond)
+
+	h := &StreamHeader{Destination: "prometheus:9090", Metadata: map[string]string{StreamMetadataRequestID: "4bf92f3577b34da6"}, streamID: 5}
+	assert.Equal(t, "prometheus:9090 (stream_id=5, request_id=4bf92f3577b34da6)", h.String())
+}
+
+func TestDestSocksProxy(t *testing.T) {
+	s := testSettings()
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer destination.Close()
+	_, port, err := net.SplitHostPort(destination.Listener.Addr().String())
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	requested := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go socks5Connect(conn, requested)
+		}
+	}()
+	s.destSocksProxy = "socks5://user:password@" + listener.Addr().String()
+
+	stream := serveStream(newProxy(s))
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{Destination: "localhost:" + port}))
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, "localhost:"+port, <-requested)
+}
+
+// socks5Connect serves a SOCKS5 CONNECT request authenticated with user:password and reports the requested address.
+func socks5Connect(conn net.Conn, requested chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readPrefixed := func() string {
+		size, _ := r.ReadByte()
+		b := make([]byte, size)
+		_, _ = io.ReadFull(r, b)
+		return string(b)
+	}
+	_, _ = r.ReadByte() // version
+	_ = readPrefixed()  // methods
+	_, _ = conn.Write([]byte{5, 2})
+	_, _ = r.ReadByte() // version of the username/password negotiation
+	if user, password := readPrefixed(), readPrefixed(); user != "user" || password != "password" {
+		_, _ = conn.Write([]byte{1, 1})
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	head := make([]byte, 4) // version, command, reserved, address type
+	if _, err := io.ReadFull(r, head); err != nil || head[1] != 1 || head[3] != 3 {
+		return
+	}
+	host := readPrefixed()
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	requested <- addr
+	dest, err := net.Dial("tcp", addr)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer dest.Close()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() {
+		_, _ = io.Copy(dest, r)
+	}()
+	_, _ = io.Copy(conn, dest)
+}
+
+func TestDestTLS(t *testing.T) {
+	s := testSettings()
+	s.destTLS, s.destTLSSkipVerify, s.destTLSNextProtos = true, true, []string{"h2", "http/1.1"}
+
+	offered := make(chan []string, 1)
+	destination := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	destination.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedProtos
+			return nil, nil
+		},
+	}
+	destination.StartTLS()
+	defer destination.Close()
+
+	stream := serveStream(newProxy(s))
+	defer stream.Close()
+	_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: destination.Listener.Addr().String()}))
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", string(body))
+	assert.Equal(t, []string{"h2", "http/1.1"}, <-offered)
+}
+
+func TestDestMaxRPS(t *testing.T) {
+	s := testSettings()
+	s.rateLimiter = newRateLimiter(3)
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ok"))
+	}))
+	open := func(dest string) net.Conn {
+		stream := serveStream(p)
+		_, err := stream.Write(encodeStreamHeader(StreamHeader{Destination: dest, Metadata: map[string]string{StreamMetadataErrorFrames: "true"}}))
+		require.NoError(t, err)
+		return stream
+	}
+	proxied := func(dest string) bool {
+		stream := open(dest)
+		defer stream.Close()
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		return string(buf) == "ok"
+	}
+	// the metrics are shared by the tests, so the destinations are unique to the test run
+	dest, other := fmt.Sprintf("rps-%d:9090", time.Now().UnixNano()), fmt.Sprintf("rps-other-%d:9090", time.Now().UnixNano())
+	limited := destinationRateLimited.WithLabelValues(s.destinations.label(dest))
+	before := testutil.ToFloat64(limited)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, proxied(dest))
+	}
+	stream := open(dest)
+	status, message := readStreamError(t, stream)
+	_ = stream.Close()
+	assert.Equal(t, StreamStatusRateLimited, status)
+	assert.Equal(t, "the streams to "+dest+" exceed 3 per second", message)
+	assert.Equal(t, before+1, testutil.ToFloat64(limited))
+	assert.True(t, proxied(other), "the limit is per destination")
+
+	time.Sleep(time.Second / 3)
+	assert.True(t, proxied(dest))
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	s := testSettings()
+	s.maxConcurrentStreams, s.copyBufferSize = 2, 16*1024
+	logs := captureLogs(t)
+
+	s.logMemoryBound()
+	// 2 streams * (256 KiB yamux window + 2 * 64 KiB UDP buffers)
+	assert.Contains(t, logs.String(), "the streams of each gateway session use up to 0.7 MiB: 2 concurrent streams with 16384 byte copy buffers")
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}))
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	go func() {
+		_ = p.Serve(context.Background(), agentSide)
+	}()
+	session, err := yamux.Client(gwSide, nil)
+	require.NoError(t, err)
+	defer session.Close()
+	echo := func(stream net.Conn) {
+		_, err := stream.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	}
+
+	before := testutil.ToFloat64(streamsRejected)
+	first, err := openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	echo(first)
+	second, err := openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	defer second.Close()
+	echo(second)
+
+	rejected, err := openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	defer rejected.Close()
+	status, message := readStreamError(t, rejected)
+	assert.Equal(t, StreamStatusUnavailable, status)
+	assert.Equal(t, "the session has reached 2 concurrent streams", message)
+	assert.Equal(t, before+1, testutil.ToFloat64(streamsRejected))
+
+	require.NoError(t, first.Close())
+	// the slot is freed once the stream is closed on the agent's side
+	assert.Eventually(t, func() bool {
+		stream, err := openStream(session, "prometheus:9090")
+		if err != nil {
+			return false
+		}
+		defer stream.Close()
+		_, _ = stream.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(stream, buf)
+		return err == nil && string(buf) == "ping"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConcurrentStreamsWithMaxStreamsPerSession(t *testing.T) {
+	s := testSettings()
+	s.maxConcurrentStreams, s.maxStreamsPerSession = 1, 2
+
+	p := newProxyWithDialer(s, pipeDialer(func(network, addr string, conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}))
+	gwSide, agentSide := net.Pipe()
+	defer gwSide.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(context.Background(), agentSide)
+	}()
+	session, err := yamux.Client(gwSide, nil)
+	require.NoError(t, err)
+	defer session.Close()
+	echo := func(stream net.Conn) error {
+		if _, err := stream.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			return err
+		}
+		assert.Equal(t, "ping", string(buf))
+		return nil
+	}
+
+	first, err := openStream(session, "prometheus:9090")
+	require.NoError(t, err)
+	require.NoError(t, echo(first))
+	// the rejected streams don't count towards the streams served by the session
+	for i := 0; i < 3; i++ {
+		rejected, err := openStream(session, "prometheus:9090")
+		require.NoError(t, err)
+		status, _ := readStreamError(t, rejected)
+		assert.Equal(t, StreamStatusUnavailable, status)
+		_ = rejected.Close()
+	}
+	require.NoError(t, first.Close())
+
+	var second net.Conn
+	require.Eventually(t, func() bool {
+		stream, err := openStream(session, "prometheus:9090")
+		require.NotEqual(t, yamux.ErrRemoteGoAway, err, "the session has been recycled before serving 2 streams")
+		if err == nil && echo(stream) == nil {
+			second = stream
+			return true
+		}
+		if stream != nil {
+			_ = stream.Close()
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	// the second stream served reaches MAX_STREAMS_PER_SESSION
+	assert.Eventually(t, func() bool {
+		stream, err := session.Open()
+		if err == nil {
+			_ = stream.Close()
+		}
+		return err == yamux.ErrRemoteGoAway
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, second.Close())
+	select {
+	case err := <-served:
+		assert.Equal(t, errSessionRecycled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session hasn't been recycled")
+	}
+}
@@ -0,0 +1,61 @@
+package connect
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of the streams to each destination to limit per second with a token bucket,
+// so that a burst of up to limit streams is still allowed. It is shared by all the tunnels of an agent
+// to protect a destination regardless of the gateway the streams come from.
+type rateLimiter struct {
+	limit        int
+	lock         sync.Mutex
+	destinations map[string]*rateState
+	prunedAt     time.Time
+}
+
+type rateState struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{limit: limit, destinations: map[string]*rateState{}}
+}
+
+// allow returns false if the stream to the destination exceeds the rate and must be rejected.
+func (l *rateLimiter) allow(destination string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+	limit := float64(l.limit)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	// a bucket untouched for a second is full again, so it is dropped not to keep every destination ever seen
+	if now.Sub(l.prunedAt) > time.Second {
+		for d, s := range l.destinations {
+			if now.Sub(s.updatedAt) > time.Second {
+				delete(l.destinations, d)
+			}
+		}
+		l.prunedAt = now
+	}
+	s := l.destinations[destination]
+	if s == nil {
+		s = &rateState{tokens: limit}
+		l.destinations[destination] = s
+	} else {
+		s.tokens += now.Sub(s.updatedAt).Seconds() * limit
+		if s.tokens > limit {
+			s.tokens = limit
+		}
+	}
+	s.updatedAt = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package connect
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRefresh relays SIGUSR2 to c to trigger an immediate refresh of the gateway endpoints.
+func notifyRefresh(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
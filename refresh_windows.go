@@ -0,0 +1,6 @@
+package connect
+
+import "os"
+
+// notifyRefresh does nothing, as there is no SIGUSR2 on Windows.
+func notifyRefresh(c chan<- os.Signal) {}
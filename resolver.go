@@ -0,0 +1,233 @@
+package connect
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/jpillora/backoff"
+	"io"
+	"k8s.io/klog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// clockSkewThreshold is the difference between the local clock and the resolver's one worth a warning.
+	clockSkewThreshold = time.Minute
+)
+
+type resolverCacheEntry struct {
+	etag         string
+	lastModified string
+	endpoints    []string
+}
+
+// Resolver fetches the list of gateway endpoints from one of the resolvers.
+type Resolver struct {
+	settings *settings
+	urls     []string
+	token    string
+	offset   int
+	backoff  *backoff.Backoff
+	// cache keeps the last response of each resolver to make conditional requests.
+	cache map[string]resolverCacheEntry
+	// clockChecked is set once the local clock has been compared to the Date of a resolver response.
+	clockChecked bool
+}
+
+// NewResolver returns a resolver fetching the gateway endpoints from the resolvers of the config.
+func NewResolver(cfg *Config) *Resolver {
+	return newResolver(cfg.settings(), cfg.ResolverUrls, cfg.Token)
+}
+
+func newResolver(s *settings, urls []string, token string) *Resolver {
+	return &Resolver{
+		settings: s,
+		urls:     urls,
+		token:    token,
+		backoff:  &backoff.Backoff{Factor: s.resolverBackoffFactor, Min: s.resolverBackoffMin, Max: s.resolverBackoffMax},
+		cache:    map[string]resolverCacheEntry{},
+	}
+}
+
+// Resolve returns the deduplicated gateway endpoints along with the TLS server name of the resolver that returned them.
+// The resolvers are tried in order, and the starting one is rotated on each call to spread the load across them.
+// With STATIC_ENDPOINTS set, the resolvers are never contacted, and the static endpoints are returned instead.
+func (r *Resolver) Resolve() ([]string, string, error) {
+	if len(r.settings.staticEndpoints) > 0 {
+		serverName := r.settings.tlsServerName
+		if serverName == "" && len(r.urls) > 0 {
+			serverName = serverNameFromURL(r.urls[0])
+		}
+		return dedup(r.settings.staticEndpoints), serverName, nil
+	}
+	offset := r.offset
+	r.offset++
+	var errs []string
+	for i := range r.urls {
+		resolverUrl := r.urls[(offset+i)%len(r.urls)]
+		klog.Infof("updating gateways endpoints from %s", resolverUrl)
+		endpoints, err := r.getEndpoints(resolverUrl)
+		if err == nil {
+			r.backoff.Reset()
+			serverName := r.settings.tlsServerName
+			if serverName == "" {
+				serverName = serverNameFromURL(resolverUrl)
+			}
+			return dedup(endpoints), serverName, nil
+		}
+		if len(r.urls) > 1 {
+			klog.Warningf("failed to get gateway endpoints from %s: %s", resolverUrl, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", resolverUrl, err))
+	}
+	if len(errs) == 1 {
+		return nil, "", fmt.Errorf("%s", errs[0])
+	}
+	return nil, "", fmt.Errorf("all resolvers failed: %s", strings.Join(errs, "; "))
+}
+
+// serverNameFromURL returns the host of the resolver URL to verify the certificates of the gateways against.
+// IP addresses are not valid server names, so an empty string is returned for them, as well as for an unparsable URL.
+func serverNameFromURL(resolverUrl string) string {
+	u, err := url.Parse(resolverUrl)
+	if err != nil || net.ParseIP(u.Hostname()) != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// RetryIn returns the delay before the next attempt after a failure, growing exponentially until Resolve succeeds.
+func (r *Resolver) RetryIn() time.Duration {
+	return r.backoff.Duration()
+}
+
+func (r *Resolver) getEndpoints(resolverUrl string) ([]string, error) {
+	req, _ := http.NewRequest("GET", resolverUrl, nil)
+	token := r.token
+	if r.settings.resolverTokenPrefix != "" {
+		token = r.settings.resolverTokenPrefix + " " + token
+	}
+	userAgent := r.settings.resolverUserAgent
+	if userAgent == "" {
+		userAgent = "coroot-connect/" + version
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, value := range r.settings.resolverHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set(r.settings.resolverTokenHeader, token)
+	req.Header.Set("Accept-Encoding", "gzip")
+	cached, isCached := r.cache[resolverUrl]
+	if isCached {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !r.clockChecked {
+		r.clockChecked = true
+		checkClockSkew(resolverUrl, resp.Header.Get("Date"))
+	}
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		klog.Infof("gateway endpoints from %s haven't changed", resolverUrl)
+		return cached.endpoints, nil
+	}
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the response: %s", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	payload, err := io.ReadAll(io.LimitReader(body, int64(r.settings.maxResolverResponse)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > r.settings.maxResolverResponse {
+		return nil, fmt.Errorf("the response exceeds %d bytes", r.settings.maxResolverResponse)
+	}
+	if klog.V(4) {
+		// the raw body helps to diagnose malformed responses, the token is redacted in case the resolver echoes it
+		klog.Infof("the response of %s (%s): %q", resolverUrl, resp.Status, r.redact(string(payload)))
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, r.redact(string(payload)))
+	}
+	var endpoints []string
+	dropped := 0
+	for _, e := range strings.Split(string(payload), r.settings.endpointsSeparator) {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		// a truncated response must not spawn tunnels to garbage, so the malformed endpoints are dropped
+		addr, _, _ := parseEndpoint(e, "")
+		if err := checkEndpoint(addr); err != nil {
+			klog.Warningf("dropping the malformed endpoint %q returned by %s: %s", r.redact(e), resolverUrl, err)
+			dropped++
+			continue
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 && dropped > 0 {
+		return nil, fmt.Errorf("no valid endpoints in the response")
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" || lastModified != "" {
+		r.cache[resolverUrl] = resolverCacheEntry{etag: etag, lastModified: lastModified, endpoints: endpoints}
+	} else {
+		delete(r.cache, resolverUrl)
+	}
+	return endpoints, nil
+}
+
+// redact hides the token in the resolver responses written to the log or returned in the errors.
+func (r *Resolver) redact(s string) string {
+	if r.token == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, r.token, "<redacted>")
+}
+
+// checkClockSkew warns if the local clock is off, since a skewed clock can make all the deadlines fire instantly.
+func checkClockSkew(resolverUrl, date string) {
+	if date == "" {
+		return
+	}
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	skew := time.Since(remote).Truncate(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > clockSkewThreshold {
+		klog.Warningf("the local clock differs from the clock of %s by %s, deadlines may fire unexpectedly", resolverUrl, skew)
+	}
+}
+
+func dedup(endpoints []string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, e := range endpoints {
+		e = strings.TrimSpace(e)
+		if e == "" || seen[e] {
+			continue
+		}
+		seen[e] = true
+		res = append(res, e)
+	}
+	return res
+}
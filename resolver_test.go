@@ -0,0 +1,332 @@
+package connect
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolver(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	fail := true
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "127.0.0.1:4443;127.0.0.2:4443; 127.0.0.1:4443;")
+	}))
+	defer resolver.Close()
+
+	s := testSettings()
+	r := newResolver(s, []string{resolver.URL}, token)
+	_, _, err := r.Resolve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "500 Internal Server Error")
+	assert.Equal(t, s.resolverBackoffMin, r.RetryIn())
+	_, _, err = r.Resolve()
+	require.Error(t, err)
+	assert.Equal(t, 2*s.resolverBackoffMin, r.RetryIn())
+
+	fail = false
+	endpoints, serverName, err := r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443", "127.0.0.2:4443"}, endpoints)
+	assert.Equal(t, "", serverName)
+	assert.Equal(t, s.resolverBackoffMin, r.RetryIn())
+}
+
+func TestResolverTokenHeader(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	s.resolverTokenHeader, s.resolverTokenPrefix = "Authorization", "Bearer"
+
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "127.0.0.1:4443;127.0.0.2:4443")
+	}))
+	defer resolver.Close()
+
+	endpoints, _, err := newResolver(s, []string{resolver.URL}, token).Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443", "127.0.0.2:4443"}, endpoints)
+}
+
+func TestGzippedResolverResponse(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, "127.0.0.1:4443;127.0.0.2:4443")
+		require.NoError(t, gz.Close())
+	}))
+	defer resolver.Close()
+
+	endpoints, _, err := newResolver(testSettings(), []string{resolver.URL}, token).Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443", "127.0.0.2:4443"}, endpoints)
+}
+
+func TestMultipleResolvers(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1:4443")
+	}))
+	defer resolver.Close()
+
+	endpoints, serverName, err := newResolver(testSettings(), []string{broken.URL, resolver.URL}, token).Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443"}, endpoints)
+	assert.Equal(t, "", serverName)
+
+	r := newResolver(testSettings(), []string{resolver.URL, broken.URL}, token)
+	_, _, err = r.Resolve()
+	require.NoError(t, err)
+	_, _, err = r.Resolve() // starts with the broken one
+	require.NoError(t, err)
+
+	_, _, err = newResolver(testSettings(), []string{broken.URL, broken.URL}, token).Resolve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "all resolvers failed")
+}
+
+func TestResolverCaching(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	notModified := 0
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "127.0.0.1:4443;127.0.0.2:4443")
+	}))
+	defer resolver.Close()
+
+	r := newResolver(testSettings(), []string{resolver.URL}, token)
+	for i := 0; i < 3; i++ {
+		endpoints, _, err := r.Resolve()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1:4443", "127.0.0.2:4443"}, endpoints)
+	}
+	assert.Equal(t, 2, notModified)
+}
+
+func TestResolverResponseLimit(t *testing.T) {
+	s := testSettings()
+	s.maxResolverResponse = 64
+
+	body := "127.0.0.1:10001;127.0.0.1:10002"
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer resolver.Close()
+
+	endpoints, _, err := newResolver(s, []string{resolver.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:10001", "127.0.0.1:10002"}, endpoints)
+
+	body = strings.Repeat("127.0.0.1:10001;", 10)
+	_, _, err = newResolver(s, []string{resolver.URL}, "token").Resolve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds 64 bytes")
+}
+
+func TestResolverClockSkew(t *testing.T) {
+	logs := captureLogs(t)
+	date := time.Now().Add(-time.Hour)
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte("127.0.0.1:10001"))
+	}))
+	defer resolver.Close()
+
+	date = time.Now()
+	_, _, err := newResolver(testSettings(), []string{resolver.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.NotContains(t, logs.String(), "the local clock differs")
+
+	date = time.Now().Add(-time.Hour)
+	r := newResolver(testSettings(), []string{resolver.URL}, "token")
+	_, _, err = r.Resolve()
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), "the local clock differs from the clock of "+resolver.URL+" by 1h0m")
+
+	_, _, err = r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(logs.String(), "the local clock differs"))
+}
+
+func TestResolverCustomHeaders(t *testing.T) {
+	s := testSettings()
+	s.resolverHeaders = map[string]string{"X-Api-Key": "key", "X-Tenant-Id": "tenant"}
+
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "key" || r.Header.Get("X-Tenant-Id") != "tenant" || r.Header.Get("X-Token") != "token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("127.0.0.1:10001"))
+	}))
+	defer resolver.Close()
+
+	endpoints, _, err := newResolver(s, []string{resolver.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:10001"}, endpoints)
+}
+
+func TestResolverEndpointsSeparator(t *testing.T) {
+	s := testSettings()
+	s.endpointsSeparator = "\n"
+
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1:10001\r\n 127.0.0.1:10002 \n\n127.0.0.1:10001\n")
+	}))
+	defer resolver.Close()
+
+	endpoints, _, err := newResolver(s, []string{resolver.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:10001", "127.0.0.1:10002"}, endpoints)
+}
+
+func TestStaticEndpoints(t *testing.T) {
+	s := testSettings()
+	s.staticEndpoints = []string{"127.0.0.1:10001", "127.0.0.1:10002@gw.example.com", "127.0.0.1:10001"}
+
+	requests := 0
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "127.0.0.1:10003")
+	}))
+	defer resolver.Close()
+
+	r := newResolver(s, []string{resolver.URL}, "token")
+	for i := 0; i < 2; i++ {
+		endpoints, serverName, err := r.Resolve()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1:10001", "127.0.0.1:10002@gw.example.com"}, endpoints)
+		assert.Equal(t, "", serverName)
+	}
+	assert.Equal(t, 0, requests)
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1:4443")
+	}))
+	defer resolver.Close()
+
+	s := testSettings()
+	r := newResolver(s, []string{resolver.URL}, "token")
+	_, serverName, err := r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "", serverName)
+
+	s.tlsServerName = "gw.example.com"
+	_, serverName, err = r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "gw.example.com", serverName)
+}
+
+func TestResolverUserAgent(t *testing.T) {
+	userAgents := make(chan string, 2)
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.Header.Get("User-Agent")
+		fmt.Fprint(w, "127.0.0.1:4443")
+	}))
+	defer resolver.Close()
+
+	s := testSettings()
+	r := newResolver(s, []string{resolver.URL}, "token")
+	_, _, err := r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "coroot-connect/"+version, <-userAgents)
+
+	s.resolverUserAgent = "coroot-connect-custom/1.0"
+	_, _, err = r.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "coroot-connect-custom/1.0", <-userAgents)
+}
+
+func TestResolverResponseLogging(t *testing.T) {
+	logs := captureLogs(t)
+	defer setLogLevel(0)
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "127.0.0.1:4443;127.0.0.1:4444#token=%s\n", r.Header.Get(s.resolverTokenHeader))
+	}))
+	defer resolver.Close()
+	r := newResolver(s, []string{resolver.URL}, token)
+
+	_, _, err := r.Resolve()
+	require.NoError(t, err)
+	assert.NotContains(t, logs.String(), "127.0.0.1:4444")
+
+	require.NoError(t, setLogLevel(4))
+	_, _, err = r.Resolve()
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), fmt.Sprintf(`the response of %s (200 OK): "127.0.0.1:4443;127.0.0.1:4444#token=<redacted>\n"`, resolver.URL))
+	assert.NotContains(t, logs.String(), token)
+}
+
+func TestResolverErrorRedacted(t *testing.T) {
+	token := "b8ea8af6-ffee-44b3-aa9a-1fc02233cfb7"
+	s := testSettings()
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "unknown token %s", r.Header.Get(s.resolverTokenHeader))
+	}))
+	defer resolver.Close()
+	r := newResolver(s, []string{resolver.URL}, token)
+
+	_, err := r.getEndpoints(resolver.URL)
+	require.Error(t, err)
+	assert.Equal(t, "403 Forbidden: unknown token <redacted>", err.Error())
+}
+
+func TestResolverMalformedEndpoints(t *testing.T) {
+	logs := captureLogs(t)
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1:4443;127.0.0.1:4444@gw.example.com;:4445;127.0.0.1:99999;127.0.0.1:44")
+	}))
+	defer resolver.Close()
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1:4443;127.0.")
+	}))
+	defer truncated.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>")
+	}))
+	defer garbage.Close()
+
+	endpoints, _, err := newResolver(testSettings(), []string{resolver.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443", "127.0.0.1:4444@gw.example.com", "127.0.0.1:44"}, endpoints)
+	assert.Contains(t, logs.String(), fmt.Sprintf(`dropping the malformed endpoint ":4445" returned by %s: missing host`, resolver.URL))
+	assert.Contains(t, logs.String(), `dropping the malformed endpoint "127.0.0.1:99999"`)
+
+	endpoints, _, err = newResolver(testSettings(), []string{truncated.URL}, "token").Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4443"}, endpoints)
+	assert.Contains(t, logs.String(), fmt.Sprintf(`dropping the malformed endpoint "127.0." returned by %s`, truncated.URL))
+
+	_, _, err = newResolver(testSettings(), []string{garbage.URL}, "token").Resolve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no valid endpoints in the response")
+}
@@ -0,0 +1,188 @@
+package connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"k8s.io/klog"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+func listenAndServe(addr string, cfg *Config, a *Agent, health *healthChecker) {
+	klog.Infof("listening on %s", addr)
+	if err := http.ListenAndServe(addr, serverHandler(cfg, a, health)); err != nil {
+		klog.Exitln("failed to start the HTTP server:", err)
+	}
+}
+
+// serverHandler serves the endpoints of the agent, health is nil unless HEALTH_CHECK_URL is configured.
+func serverHandler(cfg *Config, a *Agent, health *healthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/ready", readyHandler(a, health))
+	mux.Handle("/config", configHandler(cfg))
+	mux.Handle("/drain", drainHandler(a))
+	mux.Handle("/tunnels", tunnelsHandler(a))
+	return mux
+}
+
+// listenAndServePprof serves the profiles of the agent on PPROF_ADDRESS.
+// They are kept off LISTEN_ADDRESS, since profiling is costly and exposes the internals of the agent.
+func listenAndServePprof(addr string) {
+	klog.Infof("serving pprof on %s", addr)
+	if err := http.ListenAndServe(addr, pprofHandler()); err != nil {
+		klog.Exitln("failed to start the pprof server:", err)
+	}
+}
+
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// drainSignal is closed once a drain of the agent has been requested.
+type drainSignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newDrainSignal() *drainSignal {
+	return &drainSignal{ch: make(chan struct{})}
+}
+
+func (d *drainSignal) request() {
+	d.once.Do(func() {
+		close(d.ch)
+	})
+}
+
+func (d *drainSignal) requested() bool {
+	select {
+	case <-d.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *drainSignal) C() <-chan struct{} {
+	return d.ch
+}
+
+// healthChecker checks the health of a destination over HTTP, since a destination accepting TCP connections
+// can still fail to serve requests, e.g. Prometheus responding with 503 to /-/healthy while starting.
+type healthChecker struct {
+	url    string
+	client *http.Client
+	lock   sync.Mutex
+	err    error
+}
+
+func newHealthChecker(url string, timeout time.Duration) *healthChecker {
+	return &healthChecker{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		err:    fmt.Errorf("not checked yet"),
+	}
+}
+
+func (h *healthChecker) check() {
+	err := func() error {
+		resp, err := h.client.Get(h.url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}()
+	h.lock.Lock()
+	prev := h.err
+	h.err = err
+	h.lock.Unlock()
+	switch {
+	case err != nil && (prev == nil || prev.Error() != err.Error()):
+		klog.Warningf("the health check of %s failed: %s", h.url, err)
+	case err == nil && prev != nil:
+		klog.Infof("the health check of %s passed", h.url)
+	}
+}
+
+func (h *healthChecker) healthy() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.err
+}
+
+func (h *healthChecker) run(interval time.Duration) {
+	for {
+		h.check()
+		time.Sleep(interval)
+	}
+}
+
+func drainHandler(a *Agent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		klog.Infoln("drain requested")
+		a.stop.request()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+func readyHandler(a *Agent, health *healthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.stop.requested() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		if !a.connected.hasEndpoints() {
+			http.Error(w, "the resolver returned no endpoints", http.StatusServiceUnavailable)
+			return
+		}
+		if health != nil {
+			if err := health.healthy(); err != nil {
+				http.Error(w, "the destination health check failed: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if !a.connected.ready() {
+			http.Error(w, "no tunnels have been connected for more than "+a.settings.allDownTimeout.String(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+func tunnelsHandler(a *Agent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a.tunnels.status()); err != nil {
+			klog.Errorln("failed to encode the tunnels:", err)
+		}
+	})
+}
+
+func configHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cfg.Redacted()); err != nil {
+			klog.Errorln("failed to encode the config:", err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// A stream starts with the uint16 size of the destination address followed by the address itself.
+// If the highest bit of the size is set, the address is followed by the uint16 size of the metadata
+// and the metadata in the form of newline-separated key=value pairs.
+// Gateways unaware of metadata never set the bit, so the format stays backward compatible.
+const streamMetadataFlag = 0x8000
+
+const (
+	StreamMetadataSource    = "source"
+	StreamMetadataRequestID = "request_id"
+	// StreamMetadataTarget is a logical name of the destination resolved against TARGETS.
+	// It takes precedence over the destination address.
+	StreamMetadataTarget = "target"
+	// StreamMetadataErrorFrames=true means that the gateway tells error frames from the destination's data.
+	StreamMetadataErrorFrames = "error_frames"
+)
+
+type StreamHeader struct {
+	Destination string
+	Metadata    map[string]string
+	// streamID is the yamux ID of the stream, 0 if unknown, so that the log lines of a stream can be correlated
+	// even if it fails before the destination is read.
+	streamID uint32
+}
+
+func (h *StreamHeader) String() string {
+	destination := h.Destination
+	if destination == "" {
+		destination = "unknown destination"
+	}
+	var attrs []string
+	if h.streamID != 0 {
+		attrs = append(attrs, fmt.Sprintf("stream_id=%d", h.streamID))
+	}
+	if id := h.Metadata[StreamMetadataRequestID]; id != "" {
+		attrs = append(attrs, "request_id="+id)
+	}
+	if len(attrs) == 0 {
+		return destination
+	}
+	return fmt.Sprintf("%s (%s)", destination, strings.Join(attrs, ", "))
+}
+
+// readStreamHeader reads the header of a stream rejecting the destinations longer than maxSize.
+func readStreamHeader(r io.Reader, maxSize int) (*StreamHeader, error) {
+	var dstLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &dstLen); err != nil {
+		return nil, fmt.Errorf("failed to read the destination size: %s", err)
+	}
+	withMetadata := dstLen&streamMetadataFlag != 0
+	dstLen &^= streamMetadataFlag
+	if int(dstLen) > maxSize {
+		return nil, fmt.Errorf("implausible destination size %d (max %d), closing the stream", dstLen, maxSize)
+	}
+	dest := make([]byte, int(dstLen))
+	if _, err := io.ReadFull(r, dest); err != nil {
+		return nil, fmt.Errorf("failed to read the destination address: %s", err)
+	}
+	h := &StreamHeader{Destination: string(dest), Metadata: map[string]string{}}
+	if !withMetadata {
+		return h, nil
+	}
+	var metadataLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &metadataLen); err != nil {
+		return nil, fmt.Errorf("failed to read the metadata size: %s", err)
+	}
+	metadata := make([]byte, int(metadataLen))
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		return nil, fmt.Errorf("failed to read the metadata: %s", err)
+	}
+	for _, line := range strings.Split(string(metadata), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			h.Metadata[k] = v
+		}
+	}
+	return h, nil
+}
+
+// writeStreamHeader writes the header the way the gateways do, in the format without metadata if there is none.
+func writeStreamHeader(w io.Writer, h *StreamHeader) error {
+	buf := &bytes.Buffer{}
+	if len(h.Metadata) == 0 {
+		_ = binary.Write(buf, binary.LittleEndian, uint16(len(h.Destination)))
+		buf.WriteString(h.Destination)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(h.Destination))|streamMetadataFlag)
+	buf.WriteString(h.Destination)
+	var lines []string
+	for k, v := range h.Metadata {
+		lines = append(lines, k+"="+v)
+	}
+	sort.Strings(lines)
+	metadata := strings.Join(lines, "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(metadata)))
+	buf.WriteString(metadata)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+const (
+	StreamStatusForbidden     uint16 = 403
+	StreamStatusUnknownTarget uint16 = 404
+	StreamStatusRateLimited   uint16 = 429
+	StreamStatusUnreachable   uint16 = 502
+	StreamStatusUnavailable   uint16 = 503
+)
+
+// writeStreamError lets the gateway know why a stream is being closed.
+// The frame has the same layout as the handshake response: a ResponseHeader followed by the message.
+// A gateway can't tell the frame from the data of the destination unless it has opted in with StreamMetadataErrorFrames,
+// so otherwise nothing is written, and the stream is just closed.
+func writeStreamError(c net.Conn, header *StreamHeader, status uint16, message string) {
+	if header.Metadata[StreamMetadataErrorFrames] != "true" {
+		return
+	}
+	if len(message) > math.MaxUint16 {
+		message = message[:math.MaxUint16]
+	}
+	h := ResponseHeader{Status: status, MessageSize: uint16(len(message))}
+	if err := binary.Write(c, binary.LittleEndian, h); err != nil {
+		return
+	}
+	_, _ = c.Write([]byte(message))
+}
+
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader builds a PROXY protocol v2 header.
+// If the source address is unknown, the LOCAL command is used so that the destination uses the real connection endpoints.
+func proxyProtocolHeader(src, dst netip.AddrPort) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(proxyProtocolSignature)
+	if !src.IsValid() || !dst.IsValid() {
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	buf.WriteByte(0x21) // v2, PROXY
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcIP.Is4() && dstIP.Is4() {
+		buf.WriteByte(0x11) // TCP over IPv4
+		_ = binary.Write(buf, binary.BigEndian, uint16(12))
+	} else {
+		buf.WriteByte(0x21) // TCP over IPv6
+		_ = binary.Write(buf, binary.BigEndian, uint16(36))
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	buf.Write(srcIP.AsSlice())
+	buf.Write(dstIP.AsSlice())
+	_ = binary.Write(buf, binary.BigEndian, src.Port())
+	_ = binary.Write(buf, binary.BigEndian, dst.Port())
+	return buf.Bytes()
+}
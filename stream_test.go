@@ -0,0 +1,129 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStreamHeader(t *testing.T) {
+	h, err := readStreamHeader(bytes.NewReader(encodeStreamHeader(StreamHeader{Destination: "127.0.0.1:9090"})), testSettings().maxDestinationSize)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", h.Destination)
+	assert.Empty(t, h.Metadata)
+
+	h, err = readStreamHeader(bytes.NewReader(encodeStreamHeader(StreamHeader{
+		Destination: "127.0.0.1:9090",
+		Metadata:    map[string]string{StreamMetadataSource: "203.0.113.7:51234", "foo": "bar"},
+	})), testSettings().maxDestinationSize)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", h.Destination)
+	assert.Equal(t, map[string]string{StreamMetadataSource: "203.0.113.7:51234", "foo": "bar"}, h.Metadata)
+}
+
+func TestStreamRequestID(t *testing.T) {
+	logs := captureLogs(t)
+	session := startProxy(t, testSettings())
+
+	stream, err := session.Open()
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{
+		Destination: "127.0.0.1:1",
+		Metadata:    map[string]string{StreamMetadataRequestID: "4bf92f3577b34da6", StreamMetadataErrorFrames: "true"},
+	}))
+	require.NoError(t, err)
+	status, _ := readStreamError(t, stream)
+	assert.Equal(t, StreamStatusUnreachable, status)
+	assert.Contains(t, logs.String(), "failed to establish a connection to 127.0.0.1:1 (stream_id=1, request_id=4bf92f3577b34da6)")
+
+	h := &StreamHeader{Destination: "127.0.0.1:9090", Metadata: map[string]string{}}
+	assert.Equal(t, "127.0.0.1:9090", h.String())
+}
+
+func TestOversizedDestination(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, binary.Write(buf, binary.LittleEndian, uint16(30000)))
+	buf.WriteString("garbage")
+	_, err := readStreamHeader(buf, testSettings().maxDestinationSize)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "implausible destination size 30000")
+
+	session := startProxy(t, testSettings())
+	stream, err := session.Open()
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, binary.Write(stream, binary.LittleEndian, uint16(1000)))
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s := testSettings()
+	s.sendProxyProtocol = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	source := make(chan netip.AddrPort, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 16+12)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if !bytes.Equal(header[:12], proxyProtocolSignature) || header[12] != 0x21 || header[13] != 0x11 {
+			return
+		}
+		ip, _ := netip.AddrFromSlice(header[16:20])
+		source <- netip.AddrPortFrom(ip, binary.BigEndian.Uint16(header[24:26]))
+		_, _ = conn.Write([]byte("ok"))
+	}()
+
+	session := startProxy(t, s)
+	stream, err := session.Open()
+	require.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Write(encodeStreamHeader(StreamHeader{
+		Destination: listener.Addr().String(),
+		Metadata:    map[string]string{StreamMetadataSource: "203.0.113.7:51234"},
+	}))
+	require.NoError(t, err)
+
+	select {
+	case src := <-source:
+		assert.Equal(t, "203.0.113.7:51234", src.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no valid PROXY protocol header received")
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	local := proxyProtocolHeader(netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:9090"))
+	assert.Equal(t, append(append([]byte{}, proxyProtocolSignature...), 0x20, 0x00, 0x00, 0x00), local)
+
+	v6 := proxyProtocolHeader(netip.MustParseAddrPort("[2001:db8::1]:51234"), netip.MustParseAddrPort("127.0.0.1:9090"))
+	require.Len(t, v6, 16+36)
+	assert.Equal(t, byte(0x21), v6[13])
+}
+
+func encodeStreamHeader(h StreamHeader) []byte {
+	buf := &bytes.Buffer{}
+	_ = writeStreamHeader(buf, &h)
+	return buf.Bytes()
+}